@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Number of lifecycle events kept per buffer
+const bufferHistory = 16
+
+// A client with at least this many live buffers is suspected of leaking
+// them when the least number it had alive rose over each of the last
+// bufferLeakWindows windows
+const (
+	bufferLeakThreshold = 32
+	bufferLeakWindow    = 5 * time.Second
+	bufferLeakWindows   = 3
+)
+
+// How long a buffer replaced by a newer commit may stay with the compositor
+// before it is reported as not released
+const bufferReleaseTimeout = time.Second
+
+// BufferEvent is a step in the life of a buffer: "created", "attached",
+// "committed", "released" or "destroyed".
+type BufferEvent struct {
+	Kind string
+	Time time.Time
+	// Surface attached to, for "attached"
+	Surface *WaylandObject
+}
+
+// BufferStats counts the buffers of a client, and their misuses.
+type BufferStats struct {
+	Live, Peak         int
+	Created, Destroyed int
+	AttachedWhileHeld  int
+	DestroyedWhileHeld int
+
+	// Least number of live buffers in the current window, and in the last
+	// completed ones, oldest first
+	windowStart time.Time
+	windowMin   int
+	minima      []int
+}
+
+// count changes the number of live buffers by delta at time t.
+func (stats *BufferStats) count(delta int, t time.Time) {
+	if t.Sub(stats.windowStart) >= bufferLeakWindow {
+		if !stats.windowStart.IsZero() {
+			stats.minima = append(stats.minima, stats.windowMin)
+			if len(stats.minima) > bufferLeakWindows+1 {
+				stats.minima = stats.minima[1:]
+			}
+		}
+		stats.windowStart = t
+		stats.windowMin = stats.Live
+	}
+	stats.Live += delta
+	if stats.Live > stats.Peak {
+		stats.Peak = stats.Live
+	}
+	if stats.Live < stats.windowMin {
+		stats.windowMin = stats.Live
+	}
+}
+
+// growing reports whether the least number of live buffers rose over each
+// of the last completed windows.
+func (stats *BufferStats) growing() bool {
+	if len(stats.minima) <= bufferLeakWindows {
+		return false
+	}
+	for idx := 1; idx < len(stats.minima); idx++ {
+		if stats.minima[idx] <= stats.minima[idx-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// Warnings describes how the client has misused its buffers, including a
+// suspected leak.
+func (stats *BufferStats) Warnings() []string {
+	var warnings []string
+	if stats.Live >= bufferLeakThreshold && stats.growing() {
+		warnings = append(warnings, fmt.Sprintf(
+			"%d live buffers and growing (%d created, %d destroyed)",
+			stats.Live, stats.Created, stats.Destroyed))
+	}
+	if stats.AttachedWhileHeld > 0 {
+		warnings = append(warnings, fmt.Sprintf(
+			"%d buffer attaches while held by the compositor", stats.AttachedWhileHeld))
+	}
+	if stats.DestroyedWhileHeld > 0 {
+		warnings = append(warnings, fmt.Sprintf(
+			"%d buffers destroyed while held by the compositor", stats.DestroyedWhileHeld))
+	}
+	return warnings
+}
+
+// NewBuffer sets up the model of a wl_buffer created by any means.
+func (client *Client) NewBuffer(obj *WaylandObject, bufferType WlBufferType) *WlBuffer {
+	buffer := &WlBuffer{
+		Object:     obj,
+		BufferType: bufferType,
+		client:     client,
+	}
+	buffer.record("created", client.packetTime, nil)
+	obj.Data = buffer
+
+	client.BufferStats.Created++
+	client.BufferStats.count(1, client.packetTime)
+	return buffer
+}
+
+// record adds a step to the history, forgetting the oldest but creation
+// once it is full.
+func (b *WlBuffer) record(kind string, t time.Time, surface *WaylandObject) {
+	if len(b.History) == bufferHistory {
+		b.History = append(b.History[:1], b.History[2:]...)
+	}
+	b.History = append(b.History, BufferEvent{kind, t, surface})
+}
+
+func (b *WlBuffer) attach(surface *WaylandObject, t time.Time) {
+	if b.Held {
+		b.AttachedWhileHeld++
+		b.client.BufferStats.AttachedWhileHeld++
+	}
+	b.record("attached", t, surface)
+}
+
+func (b *WlBuffer) commit(t time.Time) {
+	b.Held = true
+	b.Commits++
+	b.CommittedAt = t
+	b.ReplacedAt = time.Time{}
+	b.record("committed", t, nil)
+}
+
+func (b *WlBuffer) release(t time.Time) {
+	if b.Held {
+		b.holdTime.add(t.Sub(b.CommittedAt))
+	}
+	b.Held = false
+	b.Releases++
+	b.record("released", t, nil)
+}
+
+func (b *WlBuffer) destroyed(t time.Time) {
+	if b.Held {
+		b.DestroyedWhileHeld = true
+		b.client.BufferStats.DestroyedWhileHeld++
+	}
+	b.record("destroyed", t, nil)
+}
+
+// replaced notes that the surface has committed another buffer, after
+// which the compositor should release this one.
+func (b *WlBuffer) replaced(t time.Time) {
+	if b.Held {
+		b.ReplacedAt = t
+	}
+}
+
+// Warnings describes how the buffer has been misused, as of now.
+func (b *WlBuffer) Warnings(now time.Time) []string {
+	var warnings []string
+	if b.AttachedWhileHeld > 0 {
+		warnings = append(warnings, fmt.Sprintf(
+			"attached while held by the compositor (%d times)", b.AttachedWhileHeld))
+	}
+	if b.DestroyedWhileHeld {
+		warnings = append(warnings, "destroyed while held by the compositor")
+	}
+	if b.Held && !b.ReplacedAt.IsZero() && now.Sub(b.ReplacedAt) > bufferReleaseTimeout {
+		warnings = append(warnings, fmt.Sprintf(
+			"replaced but not released for %s", now.Sub(b.ReplacedAt).Truncate(time.Second)))
+	}
+	return warnings
+}
+
+// Lifecycle describes the recent history of the buffer, each step with the
+// time since the previous one.
+func (b *WlBuffer) Lifecycle() string {
+	var steps []string
+	for idx, ev := range b.History {
+		step := ev.Kind
+		if ev.Surface != nil {
+			step += " to " + ev.Surface.String()
+		}
+		if idx == 0 {
+			step += " at " + ev.Time.Format("15:04:05.000")
+		} else {
+			step += " +" + formatMillis(ev.Time.Sub(b.History[idx-1].Time))
+		}
+		steps = append(steps, step)
+	}
+	return strings.Join(steps, ", ")
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Capture files start with captureMagic, a uint32 format version and the
+// wall clock start time in nanoseconds since the epoch. The header is
+// followed by records, all little-endian:
+//
+//	uint8  kind
+//	uint32 client id
+//	int64  nanoseconds since the start of the capture (monotonic)
+//
+// and then, depending on kind:
+//
+//	connect:    int32 pid
+//	disconnect: string error ("" if the client hung up cleanly)
+//	packet:     uint8 direction (0 request, 1 event), uint32 object id,
+//	            uint16 opcode, bytes payload, uint32 fd count, and for each
+//	            fd: int32 number, uint32 mode, int64 size, bytes content,
+//	            then uint32 buffer id and bytes buffer content
+//
+// Fd content is only stored for regular files (such as shm pools and
+// keymaps) of up to captureMaxFdContent bytes, and is empty otherwise. The
+// buffer id and content hold the shm buffer attached by a wl_surface.commit,
+// as it was when the client committed it, and are 0 and empty for other
+// packets. Version 1 files have no fd content field, and versions before 3
+// no buffer fields.
+//
+// Strings and byte slices are a uint32 length followed by the data.
+const (
+	captureMagic        = "WLHAXCAP"
+	captureVersion      = 3
+	captureMaxFdContent = 16 << 20
+)
+
+type CaptureKind uint8
+
+const (
+	CaptureConnect CaptureKind = iota
+	CaptureDisconnect
+	CapturePacket
+)
+
+// CaptureFd describes a file descriptor passed alongside a packet, as seen
+// by fstat(2) at the time the packet was proxied.
+type CaptureFd struct {
+	Fd      int32
+	Mode    uint32
+	Size    int64
+	Content []byte
+}
+
+// CaptureBuffer is the content of a shm buffer at the time a surface
+// committed it.
+type CaptureBuffer struct {
+	Buffer  uint32
+	Content []byte
+}
+
+type CaptureRecord struct {
+	Kind     CaptureKind
+	ClientId uint32
+	Time     time.Time
+
+	Pid    int32
+	Err    string
+	Event  bool
+	Packet *WaylandPacket
+	Fds    []CaptureFd
+}
+
+type CaptureWriter struct {
+	file  *os.File
+	w     *bufio.Writer
+	start time.Time
+	lock  sync.Mutex
+}
+
+func NewCaptureWriter(path string) (*CaptureWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	cw := &CaptureWriter{
+		file:  f,
+		w:     bufio.NewWriter(f),
+		start: time.Now(),
+	}
+	cw.w.WriteString(captureMagic)
+	binary.Write(cw.w, binary.LittleEndian, uint32(captureVersion))
+	binary.Write(cw.w, binary.LittleEndian, cw.start.UnixNano())
+	if err := cw.w.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *CaptureWriter) writeHeader(kind CaptureKind, client *Client, t time.Time) {
+	binary.Write(cw.w, binary.LittleEndian, uint8(kind))
+	binary.Write(cw.w, binary.LittleEndian, client.id)
+	binary.Write(cw.w, binary.LittleEndian, int64(t.Sub(cw.start)))
+}
+
+func (cw *CaptureWriter) writeBytes(b []byte) {
+	binary.Write(cw.w, binary.LittleEndian, uint32(len(b)))
+	cw.w.Write(b)
+}
+
+func (cw *CaptureWriter) WriteConnect(client *Client) error {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	cw.writeHeader(CaptureConnect, client, time.Now())
+	binary.Write(cw.w, binary.LittleEndian, client.pid)
+	return cw.w.Flush()
+}
+
+func (cw *CaptureWriter) WriteDisconnect(client *Client) error {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	cw.writeHeader(CaptureDisconnect, client, time.Now())
+	var msg string
+	if client.Err != nil && client.Err != io.EOF {
+		msg = client.Err.Error()
+	}
+	cw.writeBytes([]byte(msg))
+	return cw.w.Flush()
+}
+
+// WritePacket records a packet. It must be called before the packet's fds
+// are closed.
+func (cw *CaptureWriter) WritePacket(client *Client, packet *WaylandPacket, event bool) error {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	cw.writeHeader(CapturePacket, client, packet.Timestamp)
+	var dir uint8
+	if event {
+		dir = 1
+	}
+	binary.Write(cw.w, binary.LittleEndian, dir)
+	binary.Write(cw.w, binary.LittleEndian, packet.ObjectId)
+	binary.Write(cw.w, binary.LittleEndian, packet.Opcode)
+	cw.writeBytes(packet.Arguments)
+	binary.Write(cw.w, binary.LittleEndian, uint32(len(packet.Fds)))
+	for _, fd := range packet.Fds {
+		var st unix.Stat_t
+		unix.Fstat(int(fd), &st)
+		binary.Write(cw.w, binary.LittleEndian, int32(fd))
+		binary.Write(cw.w, binary.LittleEndian, uint32(st.Mode))
+		binary.Write(cw.w, binary.LittleEndian, int64(st.Size))
+		var content []byte
+		if st.Mode&unix.S_IFMT == unix.S_IFREG && st.Size <= captureMaxFdContent {
+			content = make([]byte, st.Size)
+			n, _ := unix.Pread(int(fd), content, 0)
+			content = content[:max(n, 0)]
+		}
+		cw.writeBytes(content)
+	}
+	var buffer CaptureBuffer
+	if packet.Content != nil {
+		buffer = *packet.Content
+	}
+	binary.Write(cw.w, binary.LittleEndian, buffer.Buffer)
+	cw.writeBytes(buffer.Content)
+	return cw.w.Flush()
+}
+
+func (cw *CaptureWriter) Close() error {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	cw.w.Flush()
+	return cw.file.Close()
+}
+
+type CaptureReader struct {
+	r       *bufio.Reader
+	version uint32
+	Start   time.Time
+}
+
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != captureMagic {
+		return nil, errors.New("not a wlhax capture file")
+	}
+	var version uint32
+	if err := binary.Read(br, binary.LittleEndian, &version); err != nil {
+		return nil, err
+	}
+	if version == 0 || version > captureVersion {
+		return nil, errors.New("unsupported capture file version")
+	}
+	var start int64
+	if err := binary.Read(br, binary.LittleEndian, &start); err != nil {
+		return nil, err
+	}
+	return &CaptureReader{
+		r:       br,
+		version: version,
+		Start:   time.Unix(0, start),
+	}, nil
+}
+
+func (cr *CaptureReader) readBytes() ([]byte, error) {
+	var l uint32
+	if err := binary.Read(cr.r, binary.LittleEndian, &l); err != nil {
+		return nil, err
+	}
+	b := make([]byte, l)
+	_, err := io.ReadFull(cr.r, b)
+	return b, err
+}
+
+// Next returns the next record, or io.EOF at the end of the capture.
+func (cr *CaptureReader) Next() (*CaptureRecord, error) {
+	var hdr struct {
+		Kind     uint8
+		ClientId uint32
+		Offset   int64
+	}
+	if err := binary.Read(cr.r, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	rec := &CaptureRecord{
+		Kind:     CaptureKind(hdr.Kind),
+		ClientId: hdr.ClientId,
+		Time:     cr.Start.Add(time.Duration(hdr.Offset)),
+	}
+
+	var err error
+	switch rec.Kind {
+	case CaptureConnect:
+		err = binary.Read(cr.r, binary.LittleEndian, &rec.Pid)
+	case CaptureDisconnect:
+		var msg []byte
+		msg, err = cr.readBytes()
+		rec.Err = string(msg)
+	case CapturePacket:
+		var dir uint8
+		packet := &WaylandPacket{Timestamp: rec.Time}
+		if err = binary.Read(cr.r, binary.LittleEndian, &dir); err != nil {
+			break
+		}
+		rec.Event = dir == 1
+		if err = binary.Read(cr.r, binary.LittleEndian, &packet.ObjectId); err != nil {
+			break
+		}
+		if err = binary.Read(cr.r, binary.LittleEndian, &packet.Opcode); err != nil {
+			break
+		}
+		if packet.Arguments, err = cr.readBytes(); err != nil {
+			break
+		}
+		packet.Length = uint16(len(packet.Arguments) + 8)
+		var nfds uint32
+		if err = binary.Read(cr.r, binary.LittleEndian, &nfds); err != nil {
+			break
+		}
+		for i := uint32(0); i < nfds; i++ {
+			var fd CaptureFd
+			if err = binary.Read(cr.r, binary.LittleEndian, &fd.Fd); err != nil {
+				break
+			}
+			if err = binary.Read(cr.r, binary.LittleEndian, &fd.Mode); err != nil {
+				break
+			}
+			if err = binary.Read(cr.r, binary.LittleEndian, &fd.Size); err != nil {
+				break
+			}
+			if cr.version >= 2 {
+				if fd.Content, err = cr.readBytes(); err != nil {
+					break
+				}
+			}
+			rec.Fds = append(rec.Fds, fd)
+			// The descriptors themselves are long gone; keep the count
+			// but never refer to a live fd of this process.
+			packet.Fds = append(packet.Fds, ^uintptr(0))
+		}
+		if err != nil {
+			break
+		}
+		if cr.version >= 3 {
+			var buffer CaptureBuffer
+			if err = binary.Read(cr.r, binary.LittleEndian, &buffer.Buffer); err != nil {
+				break
+			}
+			if buffer.Content, err = cr.readBytes(); err != nil {
+				break
+			}
+			if buffer.Buffer != 0 {
+				packet.Content = &buffer
+			}
+		}
+		packet.FdInfo = rec.Fds
+		packet.Reset()
+		rec.Packet = packet
+	default:
+		err = errors.New("unknown capture record")
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return rec, err
+}
+
+// LoadCapture rebuilds the clients recorded in a capture file on an offline
+// proxy, feeding every packet through RecordTx and RecordRx.
+func (proxy *Proxy) LoadCapture(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cr, err := NewCaptureReader(f)
+	if err != nil {
+		return err
+	}
+
+	clients := make(map[uint32]*Client)
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		client := clients[rec.ClientId]
+		if client == nil {
+			client = proxy.newClient(nil)
+			client.id = rec.ClientId
+			client.pid = rec.Pid
+			client.Timestamp = rec.Time
+			clients[rec.ClientId] = client
+			proxy.notifyConnect(client)
+		}
+
+		switch rec.Kind {
+		case CaptureDisconnect:
+			err := io.EOF
+			if rec.Err != "" {
+				err = errors.New(rec.Err)
+			}
+			client.closeOnce.Do(func() {
+				client.Err = err
+				client.Timestamp = rec.Time
+				proxy.notifyDisconnect(client)
+			})
+		case CapturePacket:
+			if rec.Event {
+				client.RecordRx(rec.Packet)
+			} else {
+				client.RecordTx(rec.Packet)
+			}
+		}
+	}
+}
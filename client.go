@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"sort"
 	"strings"
 
@@ -21,8 +22,9 @@ type ClientView struct {
 
 func NewClientView(client *Client) *ClientView {
 	return &ClientView{
-		client:         client,
-		folded:         make(map[string]bool),
+		client: client,
+		// Traffic graphs and globals are long and rarely interesting
+		folded:         map[string]bool{"Traffic": true, "Globals": true},
 		lineCategories: make(map[int]string),
 	}
 }
@@ -79,7 +81,31 @@ func (c *ClientView) Draw(ctx *ui.Context) {
 	}
 	printerWithStyle(statusStyle, "%s  since %s  rx: %-6d tx: %-6d globals: %-4d objects: %-4d",
 		status, client.Timestamp.Format("15:04:05"), len(client.RxLog), len(client.TxLog),
-		len(client.Globals), len(client.Objects))
+		client.advertisedGlobals(), len(client.Objects))
+	if pm := client.Paused(); pm != nil {
+		reason := "Paused"
+		if pm.Breakpoint != nil {
+			reason = fmt.Sprintf("Paused at breakpoint %d", pm.Breakpoint.Id)
+		}
+		arrow := "->"
+		if pm.Event {
+			arrow = "<-"
+		}
+		printerWithStyle(vaxis.Style{Foreground: vaxis.IndexColor(208)},
+			"%s: %s %s  (s: step, c: continue, d: drop, :edit)",
+			reason, arrow, pm.Packet)
+	}
+
+	for _, warning := range client.BufferStats.Warnings() {
+		printerWithStyle(vaxis.Style{Foreground: vaxis.IndexColor(208)},
+			"Warning: %s", warning)
+	}
+
+	c.lineCategories = make(map[int]string)
+	c.currentCategory = ""
+	c.drawProblems(y, printerWithStyle)
+	c.drawTraffic(y, ctx.Width(), printerWithStyle)
+	c.drawGlobals(y, printerWithStyle)
 
 	var categories []string
 	sorted := make(map[string][]DashboardDisplayable)
@@ -100,8 +126,6 @@ func (c *ClientView) Draw(ctx *ui.Context) {
 		sorted[category] = append(arr, displayable)
 	}
 	sort.Sort(sort.StringSlice(categories))
-	c.currentCategory = ""
-	c.lineCategories = make(map[int]string, len(categories))
 	for _, category := range categories {
 		if y == c.selected {
 			c.currentCategory = category
@@ -111,7 +135,7 @@ func (c *ClientView) Draw(ctx *ui.Context) {
 		if c.folded[category] {
 			color = vaxis.IndexColor(142) // folded
 		}
-		printerWithStyle(vaxis.Style{Foreground: color}, category)
+		printerWithStyle(vaxis.Style{Foreground: color}, "%s", category)
 
 		if c.folded[category] {
 			continue
@@ -124,6 +148,139 @@ func (c *ClientView) Draw(ctx *ui.Context) {
 	c.currentLines = y
 }
 
+// drawProblems prints the foldable Problems category at line y, if the
+// client or compositor broke the protocol.
+func (c *ClientView) drawProblems(y int, printer func(vaxis.Style, string, ...interface{})) {
+	client := c.client
+	if client.ProblemCount == 0 {
+		return
+	}
+	const category = "Problems"
+	if y == c.selected {
+		c.currentCategory = category
+	}
+	c.lineCategories[y] = category
+	color := vaxis.IndexColor(226) // expanded
+	if c.folded[category] {
+		color = vaxis.IndexColor(142) // folded
+	}
+	printer(vaxis.Style{Foreground: color}, "%s (%d)", category, client.ProblemCount)
+	if c.folded[category] {
+		return
+	}
+	if dropped := client.ProblemCount - len(client.Problems); dropped > 0 {
+		printer(vaxis.Style{}, "%s%d earlier problems not shown", Indent(0), dropped)
+	}
+	style := vaxis.Style{Foreground: vaxis.IndexColor(208)}
+	for idx := range client.Problems {
+		printer(style, "%s%s", Indent(0), &client.Problems[idx])
+	}
+}
+
+// drawGlobals prints the foldable Globals category at line y, with the
+// objects bound to each global and their versions. Removed globals are
+// dimmed, and the objects still bound to them are inert.
+func (c *ClientView) drawGlobals(y int, printer func(vaxis.Style, string, ...interface{})) {
+	const category = "Globals"
+	if y == c.selected {
+		c.currentCategory = category
+	}
+	c.lineCategories[y] = category
+	color := vaxis.IndexColor(226) // expanded
+	if c.folded[category] {
+		color = vaxis.IndexColor(142) // folded
+	}
+	client := c.client
+	advertised := client.advertisedGlobals()
+	printer(vaxis.Style{Foreground: color}, "%s (%d advertised, %d removed)", category,
+		advertised, len(client.Globals)-advertised)
+	if c.folded[category] {
+		return
+	}
+	bound := make(map[*WaylandGlobal][]string)
+	for _, obj := range client.Objects {
+		if obj.Global == nil {
+			continue
+		}
+		s := fmt.Sprintf("%s v%d", obj, obj.Version)
+		if obj.Inert() {
+			s += " (inert)"
+		}
+		bound[obj.Global] = append(bound[obj.Global], s)
+	}
+	removedStyle := vaxis.Style{Foreground: vaxis.IndexColor(244)}
+	for _, global := range client.Globals {
+		objects := "not bound"
+		if len(bound[global]) > 0 {
+			objects = strings.Join(bound[global], ", ")
+		}
+		if global.Removed.IsZero() {
+			printer(vaxis.Style{}, "%s%d: %s v%d, %s", Indent(0), global.GlobalId,
+				global.Interface, global.Version, objects)
+			continue
+		}
+		printer(removedStyle, "%s%d: %s v%d, removed at %s, %s", Indent(0), global.GlobalId,
+			global.Interface, global.Version, global.Removed.Format("15:04:05.000"), objects)
+	}
+}
+
+// Rows of each traffic graph
+const trafficGraphHeight = 2
+
+// drawTraffic prints the foldable Traffic category at line y, with graphs of
+// the recent message, commit and byte rates of the client.
+func (c *ClientView) drawTraffic(y, width int, printer func(vaxis.Style, string, ...interface{})) {
+	const category = "Traffic"
+	if y == c.selected {
+		c.currentCategory = category
+	}
+	c.lineCategories[y] = category
+	color := vaxis.IndexColor(226) // expanded
+	if c.folded[category] {
+		color = vaxis.IndexColor(142) // folded
+	}
+	printer(vaxis.Style{Foreground: color}, "%s", category)
+	if c.folded[category] {
+		return
+	}
+
+	client := c.client
+	end := client.rateEnd()
+	seconds := width - len(Indent(0))
+	if seconds > rateHistory {
+		seconds = rateHistory
+	}
+	if seconds < 2 {
+		return
+	}
+	graphStyle := vaxis.Style{Foreground: vaxis.IndexColor(44)}
+	for _, rate := range []struct {
+		label   string
+		counter *RateCounter
+		unit    string
+	}{
+		{"events received", &client.Rates.RxMessages, "msg"},
+		{"requests sent", &client.Rates.TxMessages, "msg"},
+		{"commits", &client.Rates.Commits, ""},
+		{"bytes received", &client.Rates.RxBytes, "B"},
+		{"bytes sent", &client.Rates.TxBytes, "B"},
+	} {
+		series := rate.counter.Series(end, seconds)
+		var max uint64
+		for _, v := range series {
+			if v > max {
+				max = v
+			}
+		}
+		printer(vaxis.Style{}, "%s%s: %s, peak %s", Indent(0), rate.label,
+			formatRate(series, rate.unit),
+			formatRateValue(max, rate.unit))
+		for _, row := range Graph(series, trafficGraphHeight) {
+			printer(graphStyle, "%s%s", Indent(0), row)
+		}
+	}
+}
+
 func (client *ClientView) Invalidate() {
 	ui.Invalidate()
 }
@@ -213,6 +370,15 @@ func (client *ClientView) Event(event vaxis.Event) bool {
 		case key.Matches(' '):
 			client.Toggle()
 			return true
+		case key.Matches('s'):
+			client.client.Resume(DebugStep)
+			return true
+		case key.Matches('c'):
+			client.client.Resume(DebugContinue)
+			return true
+		case key.Matches('d'):
+			client.client.Resume(DebugDrop)
+			return true
 		}
 	}
 	return false
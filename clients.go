@@ -15,10 +15,18 @@ A Wayland display is running at the Unix socket shown at the bottom of the
 screen. You can start Wayland clients pointing to this address manually, or use
 :exec <command>... to have wlhax start one for you.
 
-Commands: exec, slow, fast, clear, block, unblock, quit
+Commands: exec, pcap, send, request, slow, fast, fault, faults, clear, block,
+unblock, break, delete, breakpoints, step, continue, drop, edit, rule, rules,
+hide-global, cap-version, preview, damage, png, configure, close, quit
 `
 )
 
+// Lines taken by each client in the list
+const clientsViewLines = 3
+
+// Seconds shown by each sparkline in the list
+const clientsViewSpark = 20
+
 type ClientsView struct {
 	selected       int
 	scroll         int
@@ -48,13 +56,19 @@ func (clients *ClientsView) Draw(ctx *ui.Context) {
 		status := "Connected"
 		if client.Err != nil {
 			status = client.Err.Error()
+		} else if client.Paused() != nil {
+			status = "Paused"
 		}
 		style := vaxis.Style{}
 		if clients.selected == i {
 			style.Attribute = vaxis.AttrReverse
 		}
+		name := ""
+		if client.Name() != "" {
+			name = " (" + client.Name() + ")"
+		}
 		w := ctx.Printf(0, y, style,
-			"Client %d: %s", client.Pid(), status)
+			"Client %d%s: %s", client.Pid(), name, status)
 		ctx.Fill(w, y, ctx.Width()-w, 1, ' ', style)
 		y++
 		statusStyle := style
@@ -68,10 +82,46 @@ func (clients *ClientsView) Draw(ctx *ui.Context) {
 		w += ctx.Printf(w, y, style,
 			"rx: %-6d tx: %-6d globals: %-4d objects: %-4d",
 			len(client.RxLog), len(client.TxLog),
-			len(client.Globals), len(client.Objects))
+			client.advertisedGlobals(), len(client.Objects))
 		ctx.Fill(w, y, ctx.Width()-w, 1, ' ', style)
 		y++
+		w = clients.drawRates(ctx, y, client)
+		ctx.Fill(w, y, ctx.Width()-w, 1, ' ', vaxis.Style{})
+		y++
+	}
+}
+
+// drawRates draws sparklines of the recent traffic of a client and returns
+// the width drawn.
+func (clients *ClientsView) drawRates(ctx *ui.Context, y int, client *Client) int {
+	end := client.rateEnd()
+	sparkStyle := vaxis.Style{Foreground: vaxis.IndexColor(44)}
+	w := ctx.Printf(0, y, vaxis.Style{}, "  ")
+	for _, rate := range []struct {
+		label   string
+		counter *RateCounter
+		unit    string
+	}{
+		{"rx", &client.Rates.RxMessages, "msg"},
+		{"tx", &client.Rates.TxMessages, "msg"},
+		{"commits", &client.Rates.Commits, ""},
+		{"bytes", &client.Rates.RxBytes, "B"},
+	} {
+		series := rate.counter.Series(end, clientsViewSpark)
+		if rate.label == "bytes" {
+			tx := client.Rates.TxBytes.Series(end, clientsViewSpark)
+			for idx := range series {
+				series[idx] += tx[idx]
+			}
+		}
+		if w+clientsViewSpark+24 > ctx.Width() {
+			break
+		}
+		w += ctx.Printf(w, y, vaxis.Style{}, "%s ", rate.label)
+		w += ctx.Printf(w, y, sparkStyle, "%s", Sparkline(series))
+		w += ctx.Printf(w, y, vaxis.Style{}, " %-12s ", formatRate(series, rate.unit))
 	}
+	return w
 }
 
 func (clients *ClientsView) Invalidate() {
@@ -120,7 +170,7 @@ func (clients *ClientsView) visibleItems() int {
 	if clients.viewportHeight <= 0 {
 		return 1
 	}
-	visible := clients.viewportHeight / 2
+	visible := clients.viewportHeight / clientsViewLines
 	if visible < 1 {
 		visible = 1
 	}
@@ -178,7 +228,7 @@ func (clients *ClientsView) MouseEvent(localX int, localY int, event vaxis.Event
 		clients.ScrollBy(1)
 		return
 	case vaxis.MouseLeftButton:
-		index := clients.scroll + localY/2
+		index := clients.scroll + localY/clientsViewLines
 		if index < 0 || index >= len(clients.proxy.Clients) {
 			return
 		}
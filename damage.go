@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Most damage rectangles kept per commit in each coordinate space. More are
+// merged into their bounding box, as compositors do.
+const maxDamageRects = 32
+
+// Frames averaged in DamageStats
+const damageWindow = 60
+
+// A surface fully damaged on this share of recent frames is flagged as
+// redrawing everything.
+const fullDamageWarning = 0.9
+
+// Rect is a damaged rectangle.
+type Rect struct {
+	X, Y, W, H int32
+}
+
+func (r Rect) String() string {
+	return fmt.Sprintf("%dx%d+%d+%d", r.W, r.H, r.X, r.Y)
+}
+
+func (r Rect) overlapsAny(rects []Rect) bool {
+	for _, o := range rects {
+		if r.X < o.X+o.W && o.X < r.X+r.W && r.Y < o.Y+o.H && o.Y < r.Y+r.H {
+			return true
+		}
+	}
+	return false
+}
+
+// addDamage appends r to the damage of a commit, ignoring empty rectangles.
+func addDamage(rects []Rect, r Rect) []Rect {
+	if r.W <= 0 || r.H <= 0 {
+		return rects
+	}
+	rects = append(rects, r)
+	if len(rects) <= maxDamageRects {
+		return rects
+	}
+	return []Rect{boundingBox(rects)}
+}
+
+func boundingBox(rects []Rect) Rect {
+	x0, y0 := int64(math.MaxInt32), int64(math.MaxInt32)
+	x1, y1 := int64(math.MinInt32), int64(math.MinInt32)
+	for _, r := range rects {
+		x0 = min(x0, int64(r.X))
+		y0 = min(y0, int64(r.Y))
+		x1 = max(x1, int64(r.X)+int64(r.W))
+		y1 = max(y1, int64(r.Y)+int64(r.H))
+	}
+	return Rect{int32(x0), int32(y0), int32(min(x1-x0, math.MaxInt32)),
+		int32(min(y1-y0, math.MaxInt32))}
+}
+
+// transformRect applies an output transform to a rectangle within a
+// width x height area, like wlr_box_transform.
+func transformRect(r Rect, transform int32, width, height int32) Rect {
+	switch transform {
+	case 1: // 90
+		return Rect{height - r.Y - r.H, r.X, r.H, r.W}
+	case 2: // 180
+		return Rect{width - r.X - r.W, height - r.Y - r.H, r.W, r.H}
+	case 3: // 270
+		return Rect{r.Y, width - r.X - r.W, r.H, r.W}
+	case 4: // flipped
+		return Rect{width - r.X - r.W, r.Y, r.W, r.H}
+	case 5: // flipped-90
+		return Rect{height - r.Y - r.H, width - r.X - r.W, r.H, r.W}
+	case 6: // flipped-180
+		return Rect{r.X, height - r.Y - r.H, r.W, r.H}
+	case 7: // flipped-270
+		return Rect{r.Y, r.X, r.H, r.W}
+	}
+	return r
+}
+
+// invertTransform returns the transform undoing another.
+func invertTransform(transform int32) int32 {
+	if transform&1 != 0 && transform&4 == 0 {
+		return transform ^ 2
+	}
+	return transform
+}
+
+// surfaceGeometry is what it takes to map buffer coordinates to surface
+// coordinates.
+type surfaceGeometry struct {
+	BufferWidth, BufferHeight int32
+	Scale, Transform          int32
+	Viewport                  *WpViewport
+}
+
+// Size returns the size of the surface.
+func (g *surfaceGeometry) Size() (int32, int32) {
+	if v := g.Viewport; v != nil {
+		if v.DestSet && v.DestWidth > 0 {
+			return v.DestWidth, v.DestHeight
+		}
+		if v.SourceSet && v.SourceWidth > 0 {
+			return int32(math.Ceil(v.SourceWidth.ToDouble())),
+				int32(math.Ceil(v.SourceHeight.ToDouble()))
+		}
+	}
+	width, height := g.BufferWidth, g.BufferHeight
+	if g.Transform&1 != 0 {
+		width, height = height, width
+	}
+	return width / g.Scale, height / g.Scale
+}
+
+// toSurface maps buffer damage to surface coordinates, rounding outwards.
+func (g *surfaceGeometry) toSurface(r Rect) Rect {
+	r = transformRect(r, invertTransform(g.Transform), g.BufferWidth, g.BufferHeight)
+	x0 := float64(r.X) / float64(g.Scale)
+	y0 := float64(r.Y) / float64(g.Scale)
+	x1 := float64(r.X+r.W) / float64(g.Scale)
+	y1 := float64(r.Y+r.H) / float64(g.Scale)
+	if v := g.Viewport; v != nil && (v.SourceSet && v.SourceWidth > 0 || v.DestSet && v.DestWidth > 0) {
+		width, height := float64(g.BufferWidth)/float64(g.Scale), float64(g.BufferHeight)/float64(g.Scale)
+		if g.Transform&1 != 0 {
+			width, height = height, width
+		}
+		srcX, srcY, srcW, srcH := 0.0, 0.0, width, height
+		if v.SourceSet && v.SourceWidth > 0 {
+			srcX, srcY = v.SourceX.ToDouble(), v.SourceY.ToDouble()
+			srcW, srcH = v.SourceWidth.ToDouble(), v.SourceHeight.ToDouble()
+		}
+		dstW, dstH := g.Size()
+		sx, sy := float64(dstW)/srcW, float64(dstH)/srcH
+		x0, x1 = (x0-srcX)*sx, (x1-srcX)*sx
+		y0, y1 = (y0-srcY)*sy, (y1-srcY)*sy
+	}
+	x, y := int32(math.Floor(x0)), int32(math.Floor(y0))
+	return Rect{x, y, int32(math.Ceil(x1)) - x, int32(math.Ceil(y1)) - y}
+}
+
+// damagedArea returns the area covered by the union of rects, clipped to
+// width x height.
+func damagedArea(rects []Rect, width, height int32) int64 {
+	type span struct{ y0, y1 int64 }
+	var clipped [][4]int64
+	var xs []int64
+	for _, r := range rects {
+		x0, y0 := max(int64(r.X), 0), max(int64(r.Y), 0)
+		x1 := min(int64(r.X)+int64(r.W), int64(width))
+		y1 := min(int64(r.Y)+int64(r.H), int64(height))
+		if x0 >= x1 || y0 >= y1 {
+			continue
+		}
+		clipped = append(clipped, [4]int64{x0, y0, x1, y1})
+		xs = append(xs, x0, x1)
+	}
+	sort.Slice(xs, func(i, j int) bool { return xs[i] < xs[j] })
+
+	// Sum the covered height of each vertical slab between two edges
+	var area int64
+	for idx := 0; idx+1 < len(xs); idx++ {
+		left, right := xs[idx], xs[idx+1]
+		if left == right {
+			continue
+		}
+		var spans []span
+		for _, c := range clipped {
+			if c[0] <= left && c[2] >= right {
+				spans = append(spans, span{c[1], c[3]})
+			}
+		}
+		sort.Slice(spans, func(i, j int) bool { return spans[i].y0 < spans[j].y0 })
+		var covered, end int64
+		for _, s := range spans {
+			if s.y0 > end {
+				end = s.y0
+			}
+			if s.y1 > end {
+				covered += s.y1 - end
+				end = s.y1
+			}
+		}
+		area += covered * (right - left)
+	}
+	return area
+}
+
+// DamageStats follows how much of a surface each new frame redraws.
+type DamageStats struct {
+	// Damage of the last frame, in surface coordinates
+	Rects         []Rect
+	Width, Height int32
+	Percent       float64
+	Frames        uint32
+
+	// Damaged percentage of the most recent frames
+	recent []float64
+	next   int
+}
+
+// frame records the damage of a commit bringing a new buffer, and returns
+// the damaged percentage of the surface.
+func (stats *DamageStats) frame(surface, buffer []Rect, g *surfaceGeometry) float64 {
+	width, height := g.Size()
+	rects := make([]Rect, 0, len(surface)+len(buffer))
+	rects = append(rects, surface...)
+	for _, r := range buffer {
+		rects = append(rects, g.toSurface(r))
+	}
+	stats.Rects = rects
+	stats.Width, stats.Height = width, height
+	stats.Percent = 0
+	if width > 0 && height > 0 {
+		stats.Percent = float64(damagedArea(rects, width, height)) * 100 /
+			(float64(width) * float64(height))
+	}
+	stats.Frames++
+	if len(stats.recent) < damageWindow {
+		stats.recent = append(stats.recent, stats.Percent)
+	} else {
+		stats.recent[stats.next] = stats.Percent
+		stats.next = (stats.next + 1) % damageWindow
+	}
+	return stats.Percent
+}
+
+// Mean returns the mean damaged percentage and the share of fully damaged
+// frames, over the most recent frames.
+func (stats *DamageStats) Mean() (float64, float64) {
+	if len(stats.recent) == 0 {
+		return 0, 0
+	}
+	var sum float64
+	var full int
+	for _, p := range stats.recent {
+		sum += p
+		if p >= 99.9 {
+			full++
+		}
+	}
+	n := float64(len(stats.recent))
+	return sum / n, float64(full) / n
+}
+
+// Series returns the damaged percentage of the most recent frames, oldest
+// first.
+func (stats *DamageStats) Series() []uint64 {
+	series := make([]uint64, 0, len(stats.recent))
+	for idx := range stats.recent {
+		p := stats.recent[(stats.next+idx)%len(stats.recent)]
+		series = append(series, uint64(math.Ceil(p)))
+	}
+	return series
+}
+
+// Details describes the damage for the dashboard.
+func (stats *DamageStats) Details() []string {
+	if stats.Frames == 0 {
+		return nil
+	}
+	var rects []string
+	for _, r := range stats.Rects {
+		rects = append(rects, r.String())
+	}
+	if len(rects) == 0 {
+		rects = append(rects, "none")
+	}
+	mean, full := stats.Mean()
+	details := []string{
+		fmt.Sprintf("damage: %s, %.1f%% of %dx%d, mean %.1f%%, full on %.0f%% of frames",
+			strings.Join(rects, " "), stats.Percent, stats.Width, stats.Height, mean, full*100),
+	}
+	if len(stats.recent) >= damageWindow/2 && full >= fullDamageWarning {
+		details = append(details, "warning: redraws the whole surface on nearly every frame")
+	}
+	return details
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+
+	"git.sr.ht/~rockorager/vaxis"
+	"github.com/dwapp/wlhax/ui"
+)
+
+// DamageView draws the damage of the last frame of a surface over the
+// surface area, scaled to fit the tab.
+type DamageView struct {
+	client    *Client
+	surfaceId uint32
+}
+
+func NewDamageView(client *Client, surfaceId uint32) *DamageView {
+	return &DamageView{
+		client:    client,
+		surfaceId: surfaceId,
+	}
+}
+
+func (view *DamageView) Draw(ctx *ui.Context) {
+	ctx.Fill(0, 0, ctx.Width(), ctx.Height(), ' ', vaxis.Style{})
+	client := view.client
+	client.lock.RLock()
+	defer client.lock.RUnlock()
+
+	header := vaxis.Style{Foreground: vaxis.IndexColor(226)}
+	obj, ok := client.ObjectMap[view.surfaceId]
+	var surface *WlSurface
+	if ok {
+		surface, _ = obj.Data.(*WlSurface)
+	}
+	if surface == nil {
+		ctx.Printf(0, 0, header, "wl_surface@%d: destroyed", view.surfaceId)
+		return
+	}
+	stats := &surface.Damage
+	if stats.Frames == 0 {
+		ctx.Printf(0, 0, header, "%s: no buffer committed yet", surface.Object)
+		return
+	}
+	ctx.Printf(0, 0, header, "%s: frame %d, %d rects, %.1f%% of %dx%d damaged",
+		surface.Object, stats.Frames, len(stats.Rects), stats.Percent,
+		stats.Width, stats.Height)
+	mean, full := stats.Mean()
+	ctx.Printf(0, 1, vaxis.Style{}, "recent: %s  mean %.1f%%, full on %.0f%% of frames",
+		Sparkline(stats.Series()), mean, full*100)
+
+	cols, rows := ctx.Width(), ctx.Height()-3
+	if cols <= 0 || rows <= 0 || stats.Width <= 0 || stats.Height <= 0 {
+		return
+	}
+	// Surface pixels per column; cells are about twice as tall as wide
+	scale := math.Max(float64(stats.Width)/float64(cols),
+		float64(stats.Height)/float64(rows*2))
+	gridW := min(int(math.Ceil(float64(stats.Width)/scale)), cols)
+	gridH := min(int(math.Ceil(float64(stats.Height)/(scale*2))), rows)
+
+	damaged := vaxis.Style{Foreground: vaxis.RGBColor(255, 64, 64)}
+	clean := vaxis.Style{Foreground: vaxis.IndexColor(240)}
+	for cy := 0; cy < gridH; cy++ {
+		for cx := 0; cx < gridW; cx++ {
+			cell := Rect{
+				X: int32(float64(cx) * scale),
+				Y: int32(float64(cy) * scale * 2),
+				W: int32(math.Ceil(scale)),
+				H: int32(math.Ceil(scale * 2)),
+			}
+			if cell.overlapsAny(stats.Rects) {
+				ctx.SetCell(cx, cy+3, '█', damaged)
+			} else {
+				ctx.SetCell(cx, cy+3, '░', clean)
+			}
+		}
+	}
+}
+
+func (view *DamageView) Invalidate() {
+	ui.Invalidate()
+}
+
+func (view *DamageView) Focus(focus bool) {
+	// This space deliberately left blank
+}
+
+func (view *DamageView) Event(event vaxis.Event) bool {
+	return false
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
 	"git.sr.ht/~rockorager/vaxis"
 	"github.com/dwapp/wlhax/ui"
+	"golang.org/x/sys/unix"
 )
 
 type Dashboard struct {
@@ -17,6 +21,11 @@ type Dashboard struct {
 	status  *ui.Stack
 	tabs    *ui.Tabs
 	tabMap  map[*Client]*ClientView
+	logMap  map[*Client]*PacketLogView
+	// Surface tabs opened with :preview and :damage
+	surfaceTabs map[*Client][]ui.Drawable
+	// Fault added by :slow, 0 if none
+	slowFault int
 }
 
 func NewDashboard(proxy *Proxy) *Dashboard {
@@ -25,10 +34,13 @@ func NewDashboard(proxy *Proxy) *Dashboard {
 	tabs := ui.NewTabs()
 	tabs.Add(clients, "Connections", true)
 
+	statusText := fmt.Sprintf("WAYLAND_DISPLAY=%s -> %s",
+		proxy.ProxyDisplay(), proxy.RemoteDisplay())
+	if proxy.Offline() {
+		statusText = fmt.Sprintf("capture: %s (offline)", proxy.ProxyDisplay())
+	}
 	status := ui.NewStack()
-	status.Push(ui.NewText(
-		fmt.Sprintf("WAYLAND_DISPLAY=%s -> %s",
-			proxy.ProxyDisplay(), proxy.RemoteDisplay()),
+	status.Push(ui.NewText(statusText,
 		vaxis.Style{Foreground: vaxis.RGBColor(0, 255, 0)}))
 
 	grid := ui.NewGrid().Rows([]ui.GridSpec{
@@ -48,13 +60,21 @@ func NewDashboard(proxy *Proxy) *Dashboard {
 	grid.AddChild(status).At(2, 0).Span(1, 2)
 
 	dash := &Dashboard{
-		tabMap: make(map[*Client]*ClientView),
-		grid:   grid,
-		proxy:  proxy,
-		tabs:   tabs,
-		status: status,
+		tabMap:      make(map[*Client]*ClientView),
+		logMap:      make(map[*Client]*PacketLogView),
+		surfaceTabs: make(map[*Client][]ui.Drawable),
+		grid:        grid,
+		proxy:       proxy,
+		tabs:        tabs,
+		status:      status,
 	}
 	dash.focus(nil)
+	// Keep the traffic graphs moving while nothing happens
+	go func() {
+		for range time.Tick(time.Second) {
+			ui.Invalidate()
+		}
+	}()
 	proxy.OnUpdate(func(c *Client) {
 		clients.Invalidate()
 		v := dash.tabMap[c]
@@ -64,15 +84,13 @@ func NewDashboard(proxy *Proxy) *Dashboard {
 	})
 	proxy.OnConnect(func(c *Client) {
 		clients.Invalidate()
-		v := dash.tabMap[c]
-		if v != nil {
-			// ???
-			delete(dash.tabMap, c)
-			tabs.Remove(v)
-		}
-		v = NewClientView(c)
+		dash.removeClientTabs(c)
+		v := NewClientView(c)
 		dash.tabMap[c] = v
 		tabs.Add(v, fmt.Sprintf("Client %d", c.Pid()), false)
+		l := NewPacketLogView(c)
+		dash.logMap[c] = l
+		tabs.Add(l, fmt.Sprintf("Log %d", c.Pid()), true)
 	})
 	proxy.OnDisconnect(func(c *Client) {
 		clients.Invalidate()
@@ -84,6 +102,24 @@ func NewDashboard(proxy *Proxy) *Dashboard {
 	return dash
 }
 
+func (dash *Dashboard) removeClientTabs(c *Client) {
+	if v := dash.tabMap[c]; v != nil {
+		delete(dash.tabMap, c)
+		dash.tabs.Remove(v)
+	}
+	if l := dash.logMap[c]; l != nil {
+		delete(dash.logMap, c)
+		dash.tabs.Remove(l)
+	}
+	for _, v := range dash.surfaceTabs[c] {
+		dash.tabs.Remove(v)
+		if closeable, ok := v.(ui.Closeable); ok {
+			closeable.Close()
+		}
+	}
+	delete(dash.surfaceTabs, c)
+}
+
 func (dash *Dashboard) Draw(ctx *ui.Context) {
 	dash.grid.Draw(ctx)
 }
@@ -166,6 +202,492 @@ func (dash *Dashboard) focus(item ui.Interactive) {
 	}
 }
 
+// ShowError displays err in the status line for a few seconds.
+func (dash *Dashboard) ShowError(err error) {
+	dash.showStatus(err.Error(), vaxis.RGBColor(255, 0, 0))
+}
+
+// ShowMessage displays an informational message in the status line for a
+// few seconds.
+func (dash *Dashboard) ShowMessage(msg string) {
+	dash.showStatus(msg, vaxis.IndexColor(226))
+}
+
+func (dash *Dashboard) showStatus(msg string, color vaxis.Color) {
+	ui.QueueFunc(func() {
+		text := ui.NewText(msg, vaxis.Style{Foreground: color})
+		dash.status.Push(text)
+		ui.Invalidate()
+		time.AfterFunc(5*time.Second, func() {
+			ui.QueueFunc(func() {
+				dash.status.Remove(text)
+				ui.Invalidate()
+			})
+		})
+	})
+}
+
+// findClient looks up a connected client by pid.
+func (dash *Dashboard) findClient(pid string) (*Client, error) {
+	for _, client := range dash.proxy.Clients {
+		if strconv.Itoa(int(client.Pid())) == pid && client.Err == nil {
+			return client, nil
+		}
+	}
+	return nil, fmt.Errorf("no connected client with pid %s", pid)
+}
+
+// targetClient picks the client a command applies to: the one with the pid
+// given as first word, unless that word names an object, or else the only
+// connected client. It returns the remaining words.
+func (dash *Dashboard) targetClient(words []string) (*Client, []string, error) {
+	if len(words) > 0 && !strings.Contains(words[0], "@") {
+		client, err := dash.findClient(words[0])
+		return client, words[1:], err
+	}
+	var client *Client
+	for _, c := range dash.proxy.Clients {
+		if c.Err != nil {
+			continue
+		}
+		if client != nil {
+			return nil, nil, errors.New("several clients are connected, give a pid")
+		}
+		client = c
+	}
+	if client == nil {
+		return nil, nil, errors.New("no connected client")
+	}
+	return client, words, nil
+}
+
+// sendCommand injects a hand-written event into a client, or a request on
+// its behalf into the compositor:
+//
+//	:send [pid] interface@id event [args...]
+//	:request [pid] interface@id request [args...]
+//
+// The pid may be left out while only one client is connected.
+func (dash *Dashboard) sendCommand(text string, event bool) error {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return errors.New("usage: [pid] interface@id message [args...]")
+	}
+
+	client, rest, err := dash.targetClient(words)
+	if err != nil {
+		return err
+	}
+	if len(rest) < len(words) {
+		text = strings.TrimPrefix(strings.TrimSpace(text), words[0])
+	}
+
+	packet, err := client.ParseMessage(text, event)
+	if err != nil {
+		return err
+	}
+	for _, fd := range packet.Fds {
+		if fd == ^uintptr(0) {
+			for _, fd := range packet.Fds {
+				if fd != ^uintptr(0) {
+					unix.Close(int(fd))
+				}
+			}
+			return errors.New("- only stands for an original fd in :edit")
+		}
+	}
+	// The packet's fds are closed once it is sent or dropped
+	if event {
+		return client.WriteEvent(packet)
+	}
+	return client.WriteRequest(packet)
+}
+
+// pausedClient picks the client a debugger command applies to: the one with
+// the given pid, or the only paused client.
+func (dash *Dashboard) pausedClient(args []string) (*Client, error) {
+	if len(args) > 0 {
+		return dash.findClient(args[0])
+	}
+	var paused *Client
+	for _, client := range dash.proxy.Clients {
+		if client.Paused() == nil {
+			continue
+		}
+		if paused != nil {
+			return nil, errors.New("several clients are paused, give a pid")
+		}
+		paused = client
+	}
+	if paused == nil {
+		return nil, errors.New("no client is paused")
+	}
+	return paused, nil
+}
+
+// debugCommand handles breakpoints and paused clients:
+//
+//	:break [request|event] [interface][@id][.message] [arg<op>value...]
+//	:delete [n]
+//	:breakpoints
+//	:step [pid], :continue [pid], :drop [pid]
+//	:edit [pid] [interface@id message args...]
+func (dash *Dashboard) debugCommand(cmd string, parts []string) error {
+	debugger := &dash.proxy.Debugger
+	switch parts[0] {
+	case "break":
+		bp, err := ParseBreakpoint(parts[1:])
+		if err != nil {
+			return err
+		}
+		debugger.Add(bp)
+		dash.ShowMessage("breakpoint " + bp.String())
+		return nil
+	case "delete":
+		id := 0
+		if len(parts) > 1 {
+			var err error
+			if id, err = strconv.Atoi(parts[1]); err != nil {
+				return err
+			}
+		}
+		return debugger.Delete(id)
+	case "breakpoints":
+		var list []string
+		for _, bp := range debugger.Breakpoints() {
+			list = append(list, bp.String())
+		}
+		if len(list) == 0 {
+			list = append(list, "no breakpoints")
+		}
+		dash.ShowMessage(strings.Join(list, "; "))
+		return nil
+	case "edit":
+		// The pid may be confused with a bare object id, so only take
+		// the first word as a pid if such a client exists
+		var args []string
+		if len(parts) > 1 {
+			if _, err := dash.findClient(parts[1]); err == nil || len(parts) == 2 {
+				args = parts[1:2]
+			}
+		}
+		client, err := dash.pausedClient(args)
+		if err != nil {
+			return err
+		}
+		text := strings.TrimPrefix(strings.TrimSpace(cmd), parts[0])
+		if len(args) > 0 {
+			text = strings.TrimPrefix(strings.TrimSpace(text), args[0])
+		}
+		if strings.TrimSpace(text) != "" {
+			return client.EditPaused(text)
+		}
+		pm := client.Paused()
+		if pm == nil {
+			return errors.New("client is not paused")
+		}
+		text, err = FormatMessageText(pm.Packet)
+		if err != nil {
+			return err
+		}
+		ui.QueueFunc(func() {
+			dash.BeginExCommand(fmt.Sprintf("edit %d %s", client.Pid(), text))
+		})
+		return nil
+	}
+
+	client, err := dash.pausedClient(parts[1:])
+	if err != nil {
+		return err
+	}
+	switch parts[0] {
+	case "step":
+		return client.Resume(DebugStep)
+	case "drop":
+		return client.Resume(DebugDrop)
+	default:
+		return client.Resume(DebugContinue)
+	}
+}
+
+// ruleCommand manages the rules rewriting proxied messages:
+//
+//	:rule drop|set ...
+//	:rule enable|disable|delete [n]
+//	:rules [load <file>]
+func (dash *Dashboard) ruleCommand(cmd string, parts []string) error {
+	rules := &dash.proxy.Rules
+	if parts[0] == "rules" {
+		if len(parts) == 3 && parts[1] == "load" {
+			return rules.Load(parts[2], dash.proxy.Protocols)
+		} else if len(parts) != 1 {
+			return errors.New("usage: :rules [load <file>]")
+		}
+		var list []string
+		for _, rule := range rules.Rules() {
+			list = append(list, rule.String())
+		}
+		if len(list) == 0 {
+			list = append(list, "no rules")
+		}
+		dash.ShowMessage(strings.Join(list, "; "))
+		return nil
+	}
+
+	if len(parts) < 2 {
+		return errors.New("usage: :rule drop|set|enable|disable|delete ...")
+	}
+	switch parts[1] {
+	case "enable", "disable", "delete":
+		id := 0
+		if len(parts) > 2 {
+			var err error
+			if id, err = strconv.Atoi(parts[2]); err != nil {
+				return err
+			}
+		}
+		if parts[1] == "delete" {
+			return rules.Delete(id)
+		}
+		return rules.SetEnabled(id, parts[1] == "enable")
+	}
+	rule, err := ParseRule(strings.TrimPrefix(strings.TrimSpace(cmd), parts[0]), dash.proxy.Protocols)
+	if err != nil {
+		return err
+	}
+	rules.Add(rule)
+	dash.ShowMessage("rule " + rule.String())
+	return nil
+}
+
+// globalCommand adds a rule hiding a global from clients, or capping its
+// version:
+//
+//	:hide-global <interface> [pid|executable]
+//	:cap-version <interface> <version> [pid|executable]
+//
+// Without a pid or executable name, the rule applies to every client.
+func (dash *Dashboard) globalCommand(parts []string) error {
+	var text string
+	args := parts[1:]
+	switch parts[0] {
+	case "hide-global":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("usage: :hide-global <interface> [pid|executable]")
+		}
+		text = fmt.Sprintf("drop event wl_registry.global interface=%s", args[0])
+		args = args[1:]
+	case "cap-version":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New("usage: :cap-version <interface> <version> [pid|executable]")
+		}
+		version, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil || version == 0 {
+			return fmt.Errorf("invalid version %s", args[1])
+		}
+		text = fmt.Sprintf("set event wl_registry.global interface=%s version>%d => version=%d",
+			args[0], version, version)
+		args = args[2:]
+	}
+	if len(args) > 0 {
+		text = "for " + args[0] + " " + text
+	}
+	rule, err := ParseRule(text, dash.proxy.Protocols)
+	if err != nil {
+		return err
+	}
+	dash.proxy.Rules.Add(rule)
+	dash.ShowMessage("rule " + rule.String())
+	return nil
+}
+
+// faultCommand manages fault injection:
+//
+//	:fault delay|drop|disconnect ...
+//	:fault delete [n]
+//	:fault error [pid] interface@id <code> [message...]
+//	:faults [load <file>]
+func (dash *Dashboard) faultCommand(cmd string, parts []string) error {
+	faults := &dash.proxy.Faults
+	if parts[0] == "faults" {
+		if len(parts) == 3 && parts[1] == "load" {
+			return faults.Load(parts[2])
+		} else if len(parts) != 1 {
+			return errors.New("usage: :faults [load <file>]")
+		}
+		var list []string
+		for _, fault := range faults.Faults() {
+			list = append(list, fault.String())
+		}
+		if len(list) == 0 {
+			list = append(list, "no faults")
+		}
+		dash.ShowMessage(strings.Join(list, "; "))
+		return nil
+	}
+
+	if len(parts) < 2 {
+		return errors.New("usage: :fault delay|drop|disconnect|delete|error ...")
+	}
+	switch parts[1] {
+	case "delete":
+		id := 0
+		if len(parts) > 2 {
+			var err error
+			if id, err = strconv.Atoi(parts[2]); err != nil {
+				return err
+			}
+		}
+		if id == dash.slowFault || id == 0 {
+			dash.slowFault = 0
+		}
+		return faults.Delete(id)
+	case "error":
+		return dash.errorCommand(parts[2:])
+	}
+	fault, err := ParseFault(strings.TrimPrefix(strings.TrimSpace(cmd), parts[0]))
+	if err != nil {
+		return err
+	}
+	faults.Add(fault)
+	dash.ShowMessage("fault " + fault.String())
+	return nil
+}
+
+// errorCommand sends a wl_display.error to a client and disconnects it. The
+// code may be given by name from the error enum of the object's interface.
+func (dash *Dashboard) errorCommand(words []string) error {
+	client, words, err := dash.targetClient(words)
+	if err != nil {
+		return err
+	}
+	if len(words) < 2 {
+		return errors.New("usage: :fault error [pid] interface@id <code> [message...]")
+	}
+	iface, idText, _ := strings.Cut(words[0], "@")
+	id, err := strconv.ParseUint(idText, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid object %s", words[0])
+	}
+	client.lock.RLock()
+	object, ok := client.ObjectMap[uint32(id)]
+	client.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("no such object %d", id)
+	}
+	if iface != "" && iface != object.Interface {
+		return fmt.Errorf("%d is %s, not %s", id, object, iface)
+	}
+	code, err := strconv.ParseUint(words[1], 0, 32)
+	if err != nil {
+		value, ok := client.protocols.enumValue(object.Interface, "error", words[1])
+		if !ok {
+			return fmt.Errorf("invalid error code %s", words[1])
+		}
+		code = uint64(value)
+	}
+	message := strings.Join(words[2:], " ")
+	if message == "" {
+		message = "error injected by wlhax"
+	}
+	return client.SendError(uint32(id), uint32(code), message)
+}
+
+// surfaceCommand shows the contents or the damage of a surface in a new
+// tab, or saves its contents to a PNG file:
+//
+//	:preview [pid] [wl_surface]@id
+//	:damage [pid] [wl_surface]@id
+//	:png [pid] [wl_surface]@id <file>
+//
+// Only surfaces with a shm buffer committed can be previewed.
+func (dash *Dashboard) surfaceCommand(parts []string) error {
+	usage := fmt.Errorf("usage: :%s [pid] [wl_surface]@id", parts[0])
+	if parts[0] == "png" {
+		usage = errors.New("usage: :png [pid] [wl_surface]@id <file>")
+	}
+	client, args, err := dash.targetClient(parts[1:])
+	if err != nil {
+		return err
+	}
+	if (parts[0] != "png" && len(args) != 1) || (parts[0] == "png" && len(args) != 2) {
+		return usage
+	}
+	iface, idText, found := strings.Cut(args[0], "@")
+	id, err := strconv.ParseUint(idText, 10, 32)
+	if !found || err != nil || iface != "" && iface != "wl_surface" {
+		return usage
+	}
+
+	client.lock.RLock()
+	defer client.lock.RUnlock()
+	object, ok := client.ObjectMap[uint32(id)]
+	if !ok {
+		return fmt.Errorf("no such object %d", id)
+	}
+	surface, ok := object.Data.(*WlSurface)
+	if !ok {
+		return fmt.Errorf("%s is not a surface", object)
+	}
+	if parts[0] == "png" {
+		if surface.Snapshot == nil {
+			return fmt.Errorf("%s has no shm buffer committed", object)
+		}
+		if err := surface.Snapshot.WritePNG(args[1]); err != nil {
+			return err
+		}
+		dash.ShowMessage(fmt.Sprintf("saved commit %d of %s to %s",
+			surface.Snapshot.Commit, object, args[1]))
+		return nil
+	}
+	var view ui.Drawable
+	var name string
+	if parts[0] == "damage" {
+		view = NewDamageView(client, uint32(id))
+		name = fmt.Sprintf("Damage %d@%d", client.Pid(), id)
+	} else {
+		view = NewPreviewView(client, uint32(id))
+		name = fmt.Sprintf("Preview %d@%d", client.Pid(), id)
+	}
+	dash.surfaceTabs[client] = append(dash.surfaceTabs[client], view)
+	dash.tabs.Add(view, name, false)
+	return nil
+}
+
+// syntheticCommand handles the commands sending events from the synthetic
+// server:
+//
+//	:configure <pid> <width> <height> [state...]
+//	:close <pid>
+func (dash *Dashboard) syntheticCommand(parts []string) error {
+	server := dash.proxy.Synthetic
+	if server == nil {
+		return errors.New(parts[0] + " is only available in synthetic mode")
+	}
+	if len(parts) < 2 {
+		return errors.New("usage: " + parts[0] + " <pid> ...")
+	}
+	client, err := dash.findClient(parts[1])
+	if err != nil {
+		return err
+	}
+	if parts[0] == "close" {
+		return server.CloseToplevels(client)
+	}
+	if len(parts) < 4 {
+		return errors.New("usage: configure <pid> <width> <height> [state...]")
+	}
+	width, err := strconv.ParseInt(parts[2], 10, 32)
+	if err != nil {
+		return err
+	}
+	height, err := strconv.ParseInt(parts[3], 10, 32)
+	if err != nil {
+		return err
+	}
+	return server.Configure(client, int32(width), int32(height), parts[4:])
+}
+
 func (dash *Dashboard) BeginExCommand(cmd string) {
 	previous := dash.focused
 	exline := NewExLine(cmd, func(cmd string) {
@@ -185,27 +707,73 @@ func (dash *Dashboard) BeginExCommand(cmd string) {
 			cmd := exec.Command(parts[1], parts[2:]...)
 			cmd.Start()
 		case "slow":
-			dash.proxy.SlowMode = true
+			if dash.slowFault == 0 {
+				fault, _ := ParseFault("delay 250 request wl_surface.commit")
+				dash.proxy.Faults.Add(fault)
+				dash.slowFault = fault.Id
+			}
 		case "fast":
-			dash.proxy.SlowMode = false
+			if dash.slowFault != 0 {
+				dash.proxy.Faults.Delete(dash.slowFault)
+				dash.slowFault = 0
+			}
+		case "fault", "faults":
+			if err := dash.faultCommand(cmd, parts); err != nil {
+				dash.ShowError(err)
+			}
 		case "clear":
 			var new_clients []*Client
 			for _, client := range dash.proxy.Clients {
 				if client.Err == nil {
 					new_clients = append(new_clients, client)
 				} else {
-					v := dash.tabMap[client]
-					if v != nil {
-						delete(dash.tabMap, client)
-						dash.tabs.Remove(v)
-					}
+					dash.removeClientTabs(client)
 				}
 			}
 			dash.proxy.Clients = new_clients
 		case "block":
-			dash.proxy.Block = true
+			dash.proxy.Debugger.SetBlocked(true)
+			for _, client := range dash.proxy.Clients {
+				client.Interrupt()
+			}
 		case "unblock":
-			dash.proxy.Block = false
+			dash.proxy.Debugger.SetBlocked(false)
+			for _, client := range dash.proxy.Clients {
+				client.Resume(DebugContinue)
+			}
+		case "break", "delete", "breakpoints", "step", "continue", "c", "drop", "edit":
+			if err := dash.debugCommand(cmd, parts); err != nil {
+				dash.ShowError(err)
+			}
+		case "hide-global", "cap-version":
+			if err := dash.globalCommand(parts); err != nil {
+				dash.ShowError(err)
+			}
+		case "rule", "rules":
+			if err := dash.ruleCommand(cmd, parts); err != nil {
+				dash.ShowError(err)
+			}
+		case "preview", "damage", "png":
+			if err := dash.surfaceCommand(parts); err != nil {
+				dash.ShowError(err)
+			}
+		case "pcap":
+			if len(parts) < 2 || parts[1] == "off" {
+				dash.proxy.StopPcap()
+				break
+			}
+			if err := dash.proxy.StartPcap(parts[1]); err != nil {
+				dash.ShowError(err)
+			}
+		case "configure", "close":
+			if err := dash.syntheticCommand(parts); err != nil {
+				dash.ShowError(err)
+			}
+		case "send", "request":
+			text := strings.TrimPrefix(strings.TrimSpace(cmd), parts[0])
+			if err := dash.sendCommand(text, parts[0] == "send"); err != nil {
+				dash.ShowError(err)
+			}
 		case "closewrite":
 			dash.proxy.CloseWrite()
 		case "quit", "q":
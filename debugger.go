@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Breakpoint pauses a client when one of its messages matches.
+type Breakpoint struct {
+	Id int
+	MessagePattern
+}
+
+// ParseBreakpoint parses the arguments of :break, a MessagePattern.
+func ParseBreakpoint(words []string) (*Breakpoint, error) {
+	mp, err := ParseMessagePattern(words)
+	if err != nil {
+		return nil, err
+	}
+	return &Breakpoint{MessagePattern: mp}, nil
+}
+
+func (bp *Breakpoint) String() string {
+	return fmt.Sprintf("%d: %s", bp.Id, bp.MessagePattern)
+}
+
+// Debugger holds the breakpoints of a proxy. The zero value has none.
+type Debugger struct {
+	lock        sync.Mutex
+	breakpoints []*Breakpoint
+	nextId      int
+	// Set by :block, pauses clients that connect at their first message
+	blocked bool
+}
+
+// SetBlocked sets whether new clients start paused.
+func (d *Debugger) SetBlocked(blocked bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.blocked = blocked
+}
+
+func (d *Debugger) Blocked() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.blocked
+}
+
+func (d *Debugger) Add(bp *Breakpoint) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.nextId++
+	bp.Id = d.nextId
+	d.breakpoints = append(d.breakpoints, bp)
+}
+
+// Delete removes a breakpoint by id, or all of them if id is 0.
+func (d *Debugger) Delete(id int) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if id == 0 {
+		d.breakpoints = nil
+		return nil
+	}
+	for idx, bp := range d.breakpoints {
+		if bp.Id == id {
+			d.breakpoints = append(d.breakpoints[:idx], d.breakpoints[idx+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no breakpoint %d", id)
+}
+
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]*Breakpoint(nil), d.breakpoints...)
+}
+
+func (d *Debugger) empty() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.breakpoints) == 0
+}
+
+func (d *Debugger) match(packet *WaylandPacket, event bool) *Breakpoint {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, bp := range d.breakpoints {
+		if bp.Match(packet, event) {
+			return bp
+		}
+	}
+	return nil
+}
+
+type DebugAction int
+
+const (
+	debugWaiting DebugAction = iota
+	DebugContinue
+	DebugStep
+	DebugDrop
+)
+
+// PendingMessage is a message held back while its client is paused.
+type PendingMessage struct {
+	Packet *WaylandPacket
+	Event  bool
+	// nil if the client was paused by stepping or :block
+	Breakpoint *Breakpoint
+
+	action DebugAction
+}
+
+// clientDebug is the pause state of a client. While a message is pending,
+// both directions of the client wait in checkpoint.
+type clientDebug struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	pending  *PendingMessage
+	stepping bool
+	closed   bool
+}
+
+func (d *clientDebug) init() {
+	d.cond = sync.NewCond(&d.lock)
+}
+
+// checkpoint holds a message back while the client is paused, or if it
+// hits a breakpoint, until the user lets it through. It returns the message
+// to pass on, which may have been edited, or nil if it was dropped.
+func (client *Client) checkpoint(packet *WaylandPacket, event bool) *WaylandPacket {
+	d := &client.debug
+	if d.cond == nil {
+		return packet
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	decoded := false
+	for {
+		for d.pending != nil {
+			d.cond.Wait()
+		}
+		if d.closed || (!d.stepping && client.proxy.Debugger.empty()) {
+			return packet
+		}
+		if decoded {
+			break
+		}
+		// The client lock is taken without the debug lock, as Close takes
+		// them in the other order
+		d.lock.Unlock()
+		client.lock.Lock()
+		if object, ok := client.ObjectMap[packet.ObjectId]; ok {
+			client.decode(object, packet, event)
+		}
+		client.lock.Unlock()
+		d.lock.Lock()
+		decoded = true
+	}
+	bp := client.proxy.Debugger.match(packet, event)
+	if bp == nil && !d.stepping {
+		return packet
+	}
+
+	d.stepping = false
+	pm := &PendingMessage{
+		Packet:     packet,
+		Event:      event,
+		Breakpoint: bp,
+	}
+	d.pending = pm
+	client.proxy.notifyUpdate(client)
+	for pm.action == debugWaiting {
+		d.cond.Wait()
+	}
+	d.pending = nil
+	d.cond.Broadcast()
+	client.proxy.notifyUpdate(client)
+
+	switch pm.action {
+	case DebugStep:
+		d.stepping = !d.closed
+	case DebugDrop:
+		return nil
+	}
+	return pm.Packet
+}
+
+// Paused returns the message the client is paused on, or nil.
+func (client *Client) Paused() *PendingMessage {
+	d := &client.debug
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.pending
+}
+
+// Interrupt pauses the client at its next message.
+func (client *Client) Interrupt() {
+	d := &client.debug
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.closed {
+		d.stepping = true
+	}
+}
+
+// Resume lets the pending message of a paused client through, or drops it.
+// DebugStep pauses again at the next message.
+func (client *Client) Resume(action DebugAction) error {
+	d := &client.debug
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if action == DebugContinue {
+		d.stepping = false
+	}
+	if d.pending == nil {
+		return errors.New("client is not paused")
+	}
+	d.pending.action = action
+	d.cond.Broadcast()
+	return nil
+}
+
+// releaseDebug resumes a closing client for good. It may be called with the
+// client lock held.
+func (client *Client) releaseDebug() {
+	d := &client.debug
+	if d.cond == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.closed = true
+	d.stepping = false
+	if d.pending != nil {
+		d.pending.action = DebugContinue
+		d.cond.Broadcast()
+	}
+}
+
+// EditPaused replaces the pending message with a hand-written one, in the
+// form accepted by ParseMessage. Fd arguments written as - keep the fd at
+// the same position in the original message, which must have one.
+func (client *Client) EditPaused(text string) error {
+	pm := client.Paused()
+	if pm == nil {
+		return errors.New("client is not paused")
+	}
+	packet, err := client.ParseMessage(text, pm.Event)
+	if err != nil {
+		return err
+	}
+
+	discard := func(err error) error {
+		for _, fd := range packet.Fds {
+			if fd != ^uintptr(0) {
+				unix.Close(int(fd))
+			}
+		}
+		return err
+	}
+	for idx, fd := range packet.Fds {
+		if fd == ^uintptr(0) && idx >= len(pm.Packet.Fds) {
+			return discard(fmt.Errorf("the original message has no fd %d to keep", idx+1))
+		}
+	}
+
+	d := &client.debug
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.pending != pm {
+		return discard(errors.New("message is no longer pending"))
+	}
+	kept := make(map[int]bool)
+	for idx, fd := range packet.Fds {
+		if fd == ^uintptr(0) {
+			packet.Fds[idx] = pm.Packet.Fds[idx]
+			kept[idx] = true
+		}
+	}
+	for idx, fd := range pm.Packet.Fds {
+		if !kept[idx] {
+			unix.Close(int(fd))
+		}
+	}
+	packet.Timestamp = pm.Packet.Timestamp
+	pm.Packet = packet
+	return nil
+}
+
+// FormatMessageText writes a decoded packet in the form accepted by
+// ParseMessage.
+func FormatMessageText(packet *WaylandPacket) (string, error) {
+	if packet.Message == nil {
+		return "", errors.New("message has no known signature")
+	}
+	words := []string{
+		fmt.Sprintf("%s@%d", packet.Interface, packet.ObjectId),
+		packet.Message.Name,
+	}
+	for _, arg := range packet.Args {
+		var word string
+		switch v := arg.Value.(type) {
+		case string:
+			word = strconv.Quote(v)
+		case WaylandFixed:
+			word = strconv.FormatFloat(v.ToDouble(), 'f', -1, 64)
+		case []byte:
+			var items []string
+			for idx := 0; idx+4 <= len(v); idx += 4 {
+				items = append(items, strconv.Itoa(int(binary.LittleEndian.Uint32(v[idx:]))))
+			}
+			word = "[" + strings.Join(items, " ") + "]"
+		default:
+			switch arg.Type {
+			case "object", "new_id":
+				word = fmt.Sprintf("%s@%d", objectInterfaceName(arg.Interface), v)
+				if arg.Type == "new_id" && arg.Version != 0 {
+					word += fmt.Sprintf(":%d", arg.Version)
+				}
+			case "fd":
+				word = "-"
+			default:
+				word = fmt.Sprintf("%v", v)
+			}
+		}
+		if arg.Null {
+			word = "nil"
+		}
+		words = append(words, word)
+	}
+	return strings.Join(words, " "), nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WaylandArgument is a single message argument decoded according to the
+// protocol XML. Value holds an int32, uint32, WaylandFixed, string, []byte
+// (arrays) or int (fds), and the object id as a uint32 for object and
+// new_id arguments. Version is only set for untyped new_id arguments, which
+// carry their interface name and version on the wire.
+type WaylandArgument struct {
+	Name      string
+	Type      string
+	Interface string
+	Version   uint32
+	Null      bool
+	Value     interface{}
+}
+
+func (arg WaylandArgument) String() string {
+	if arg.Null {
+		return "nil"
+	}
+	switch v := arg.Value.(type) {
+	case WaylandFixed:
+		return fmt.Sprintf("%f", v.ToDouble())
+	case string:
+		return fmt.Sprintf("%q", v)
+	case []byte:
+		return fmt.Sprintf("array[%d]", len(v))
+	}
+	switch arg.Type {
+	case "object":
+		return fmt.Sprintf("%s@%d", objectInterfaceName(arg.Interface), arg.Value)
+	case "new_id":
+		return fmt.Sprintf("new id %s@%d", objectInterfaceName(arg.Interface), arg.Value)
+	case "fd":
+		return fmt.Sprintf("fd %d", arg.Value)
+	}
+	return fmt.Sprintf("%v", arg.Value)
+}
+
+func objectInterfaceName(iface string) string {
+	if iface == "" {
+		return "[unknown]"
+	}
+	return iface
+}
+
+// FormatArguments renders decoded arguments the way WAYLAND_DEBUG does.
+func FormatArguments(args []WaylandArgument) string {
+	parts := make([]string, len(args))
+	for idx, arg := range args {
+		parts[idx] = arg.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// String describes the packet as interface@id.message(args), falling back
+// to the raw opcode and payload size for messages without a signature.
+func (packet *WaylandPacket) String() string {
+	iface := packet.Interface
+	if iface == "" {
+		iface = "[unknown]"
+	}
+	if packet.Message == nil {
+		return fmt.Sprintf("%s@%d.opcode_%d(%d bytes)",
+			iface, packet.ObjectId, packet.Opcode, len(packet.Arguments))
+	}
+	return fmt.Sprintf("%s@%d.%s(%s)", iface, packet.ObjectId,
+		packet.Message.Name, FormatArguments(packet.Args))
+}
+
+// DecodeArguments decodes the payload of packet according to msg without
+// disturbing the packet's own read position.
+func DecodeArguments(packet *WaylandPacket, msg *ProtocolMessage) ([]WaylandArgument, error) {
+	p := &WaylandPacket{Arguments: packet.Arguments}
+	p.Reset()
+
+	var args []WaylandArgument
+	fdIndex := 0
+	for _, spec := range msg.Args {
+		arg := WaylandArgument{
+			Name:      spec.Name,
+			Type:      spec.Type,
+			Interface: spec.Interface,
+		}
+		var err error
+		switch spec.Type {
+		case "int":
+			arg.Value, err = p.ReadInt32()
+		case "uint":
+			arg.Value, err = p.ReadUint32()
+		case "fixed":
+			arg.Value, err = p.ReadFixed()
+		case "string":
+			data := p.Data()
+			if len(data) >= 4 && binary.LittleEndian.Uint32(data) == 0 {
+				arg.Null = true
+			}
+			arg.Value, err = p.ReadString()
+		case "object":
+			var id uint32
+			id, err = p.ReadUint32()
+			arg.Value = id
+			arg.Null = id == 0
+		case "new_id":
+			if spec.Interface == "" {
+				// Untyped new_id, as in wl_registry.bind, is preceded
+				// on the wire by the interface name and version.
+				arg.Interface, err = p.ReadString()
+				if err != nil {
+					break
+				}
+				arg.Version, err = p.ReadUint32()
+				if err != nil {
+					break
+				}
+			}
+			arg.Value, err = p.ReadUint32()
+		case "array":
+			arg.Value, err = p.ReadArray()
+		case "fd":
+			fd := -1
+			if fdIndex < len(packet.Fds) {
+				fd = int(packet.Fds[fdIndex])
+			}
+			fdIndex++
+			arg.Value = fd
+		default:
+			err = fmt.Errorf("unsupported argument type %q", spec.Type)
+		}
+		if err != nil {
+			return args, errors.Wrapf(err, "%s decode %s", msg.Name, spec.Name)
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// EncodeArguments is the inverse of DecodeArguments. File descriptors are
+// not part of the payload and must be passed in WaylandPacket.Fds.
+func EncodeArguments(args []WaylandArgument) ([]byte, error) {
+	var buf bytes.Buffer
+	putUint32 := func(v uint32) {
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	putBytes := func(b []byte) {
+		putUint32(uint32(len(b)))
+		buf.Write(b)
+		buf.Write(make([]byte, szup(uint32(len(b)))-uint32(len(b))))
+	}
+	putString := func(s string) {
+		putBytes(append([]byte(s), 0))
+	}
+
+	for _, arg := range args {
+		switch arg.Type {
+		case "int":
+			putUint32(uint32(arg.Value.(int32)))
+		case "uint", "object":
+			putUint32(arg.Value.(uint32))
+		case "fixed":
+			putUint32(uint32(arg.Value.(WaylandFixed)))
+		case "string":
+			if arg.Null {
+				putUint32(0)
+			} else {
+				putString(arg.Value.(string))
+			}
+		case "new_id":
+			if arg.Version != 0 {
+				putString(arg.Interface)
+				putUint32(arg.Version)
+			}
+			putUint32(arg.Value.(uint32))
+		case "array":
+			putBytes(arg.Value.([]byte))
+		case "fd":
+		default:
+			return nil, fmt.Errorf("unsupported argument type %q", arg.Type)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// argumentValue converts a Go value to an argument of the given signature.
+// Plain ints are accepted for every numeric type and float64 for fixed; nil
+// is a null object or string. Untyped new_id arguments are given as a
+// WaylandArgument.
+func argumentValue(spec ProtocolArg, v interface{}) (WaylandArgument, error) {
+	if arg, ok := v.(WaylandArgument); ok && spec.Type == "new_id" {
+		// Untyped new_id with its interface and version
+		arg.Name, arg.Type = spec.Name, spec.Type
+		return arg, nil
+	}
+	arg := WaylandArgument{
+		Name:      spec.Name,
+		Type:      spec.Type,
+		Interface: spec.Interface,
+		Null:      v == nil,
+	}
+	if n, ok := v.(int); ok {
+		switch spec.Type {
+		case "int":
+			v = int32(n)
+		case "uint", "object", "new_id":
+			v = uint32(n)
+		case "fixed":
+			v = WaylandFixed(n * 256)
+		}
+	}
+	if f, ok := v.(float64); ok && spec.Type == "fixed" {
+		v = FixedFromDouble(f)
+	}
+
+	var ok bool
+	switch spec.Type {
+	case "int":
+		_, ok = v.(int32)
+	case "uint":
+		_, ok = v.(uint32)
+	case "fixed":
+		_, ok = v.(WaylandFixed)
+	case "string":
+		if v == nil {
+			v, ok = "", spec.AllowNull
+		} else {
+			_, ok = v.(string)
+		}
+	case "object", "new_id":
+		if v == nil {
+			v, ok = uint32(0), spec.AllowNull
+		} else {
+			_, ok = v.(uint32)
+		}
+	case "array":
+		_, ok = v.([]byte)
+	case "fd":
+		_, ok = v.(int)
+	}
+	if !ok {
+		return arg, fmt.Errorf("%s: invalid %s value %v", spec.Name, spec.Type, v)
+	}
+	arg.Value = v
+	return arg, nil
+}
+
+// lookupMessage finds the request or event of an object by name. The client
+// lock must be held.
+func (client *Client) lookupMessage(objectId uint32, name string, event bool) (*WaylandObject, *ProtocolMessage, error) {
+	object, ok := client.ObjectMap[objectId]
+	if !ok {
+		return nil, nil, fmt.Errorf("no such object %d", objectId)
+	}
+	iface := client.protocols.Interface(object.Interface)
+	if iface == nil {
+		return nil, nil, fmt.Errorf("unknown interface %s", object.Interface)
+	}
+	msgs := iface.Requests
+	if event {
+		msgs = iface.Events
+	}
+	for _, m := range msgs {
+		if m.Name == name {
+			return object, m, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%s has no message %s", object.Interface, name)
+}
+
+// NewPacket builds a request or event of an object by message name,
+// encoding values according to the protocol XML. The client lock must be
+// held.
+func (client *Client) NewPacket(objectId uint32, name string, event bool, values ...interface{}) (*WaylandPacket, error) {
+	object, msg, err := client.lookupMessage(objectId, name, event)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(msg.Args) {
+		return nil, fmt.Errorf("%s.%s takes %d arguments, got %d",
+			object.Interface, name, len(msg.Args), len(values))
+	}
+
+	packet := &WaylandPacket{
+		Timestamp: time.Now(),
+		ObjectId:  objectId,
+		Opcode:    msg.Opcode,
+	}
+	args := make([]WaylandArgument, len(values))
+	for idx, v := range values {
+		arg, err := argumentValue(msg.Args[idx], v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s.%s", object.Interface, name)
+		}
+		if arg.Type == "fd" {
+			packet.Fds = append(packet.Fds, uintptr(arg.Value.(int)))
+		}
+		args[idx] = arg
+	}
+	packet.Arguments, err = EncodeArguments(args)
+	if err != nil {
+		return nil, err
+	}
+	packet.Length = uint16(len(packet.Arguments) + 8)
+	packet.Reset()
+	return packet, nil
+}
+
+// decode fills in the generic description of packet from the protocol XML.
+func (client *Client) decode(object *WaylandObject, packet *WaylandPacket, event bool) {
+	packet.Interface = object.Interface
+	msg := client.protocols.Message(object.Interface, packet.Opcode, event)
+	if msg == nil {
+		return
+	}
+	packet.Message = msg
+	args, err := DecodeArguments(packet, msg)
+	if err != nil {
+		return
+	}
+	for idx := range args {
+		arg := &args[idx]
+		switch arg.Type {
+		case "object":
+			if o, ok := client.ObjectMap[arg.Value.(uint32)]; ok && !arg.Null {
+				arg.Interface = o.Interface
+			}
+		}
+	}
+	packet.Args = args
+}
+
+// createObjects creates objects for the new_id arguments of a decoded
+// packet. They are marked generic until a semantic handler creates them
+// itself.
+func (client *Client) createObjects(packet *WaylandPacket) {
+	for _, arg := range packet.Args {
+		if arg.Type == "new_id" && arg.Interface != "" {
+			obj := client.NewObject(arg.Value.(uint32), arg.Interface)
+			obj.generic = true
+		}
+	}
+}
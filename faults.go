@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Fault disturbs the messages matching its pattern, to reproduce slow
+// compositors, lost messages and broken connections.
+type Fault struct {
+	Id int
+	// Pid or executable name of the clients the fault applies to, empty
+	// for all of them
+	Client string
+	MessagePattern
+	// "delay", "drop" or "disconnect"
+	Kind string
+	// Delay of matching messages, varied by up to Jitter either way
+	Delay, Jitter time.Duration
+	// Chance of a matching message being affected, from 0 to 1
+	Probability float64
+	// Number of matching messages let through before disconnecting
+	After int
+
+	seen map[*Client]int
+}
+
+// ParseFault parses a fault of the form
+//
+//	[for <pid|executable>] delay <ms>[~<jitter ms>] [<percent>%] [<pattern>]
+//	[for <pid|executable>] drop [<percent>%] [<pattern>]
+//	[for <pid|executable>] disconnect <n> [<pattern>]
+//
+// where the pattern is as in ParseMessagePattern. delay with only a
+// direction as pattern adds latency to every message going that way.
+func ParseFault(text string) (*Fault, error) {
+	words := strings.Fields(text)
+	fault := &Fault{Probability: 1}
+	if len(words) >= 2 && words[0] == "for" {
+		fault.Client = words[1]
+		words = words[2:]
+	}
+	if len(words) == 0 {
+		return nil, errors.New("expected delay, drop or disconnect")
+	}
+	fault.Kind, words = words[0], words[1:]
+
+	switch fault.Kind {
+	case "delay":
+		if len(words) == 0 {
+			return nil, errors.New("usage: delay <ms>[~<jitter ms>] [<percent>%] [<pattern>]")
+		}
+		delay, jitter, _ := strings.Cut(words[0], "~")
+		ms, err := strconv.ParseUint(delay, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay %s", words[0])
+		}
+		fault.Delay = time.Duration(ms) * time.Millisecond
+		if jitter != "" {
+			ms, err := strconv.ParseUint(jitter, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid jitter %s", jitter)
+			}
+			fault.Jitter = time.Duration(ms) * time.Millisecond
+		}
+		words = words[1:]
+	case "disconnect":
+		if len(words) == 0 {
+			return nil, errors.New("usage: disconnect <n> [<pattern>]")
+		}
+		n, err := strconv.ParseUint(words[0], 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid message count %s", words[0])
+		}
+		fault.After = int(n)
+		words = words[1:]
+	case "drop":
+	default:
+		return nil, fmt.Errorf("unknown fault %q, expected delay, drop or disconnect", fault.Kind)
+	}
+
+	if fault.Kind != "disconnect" && len(words) > 0 && strings.HasSuffix(words[0], "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(words[0], "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid probability %s", words[0])
+		}
+		fault.Probability = percent / 100
+		words = words[1:]
+	}
+
+	var err error
+	fault.MessagePattern, err = ParseMessagePattern(words)
+	if err != nil {
+		return nil, err
+	}
+	return fault, nil
+}
+
+func (fault *Fault) String() string {
+	parts := []string{fmt.Sprintf("%d:", fault.Id)}
+	if fault.Client != "" {
+		parts = append(parts, "for", fault.Client)
+	}
+	parts = append(parts, fault.Kind)
+	switch fault.Kind {
+	case "delay":
+		delay := strconv.FormatInt(fault.Delay.Milliseconds(), 10)
+		if fault.Jitter != 0 {
+			delay += "~" + strconv.FormatInt(fault.Jitter.Milliseconds(), 10)
+		}
+		parts = append(parts, delay)
+	case "disconnect":
+		parts = append(parts, strconv.Itoa(fault.After))
+	}
+	if fault.Probability < 1 {
+		parts = append(parts, strconv.FormatFloat(fault.Probability*100, 'f', -1, 64)+"%")
+	}
+	return strings.Join(append(parts, fault.MessagePattern.String()), " ")
+}
+
+// FaultInjector holds the faults of a proxy. The zero value has none.
+type FaultInjector struct {
+	lock   sync.Mutex
+	faults []*Fault
+	nextId int
+}
+
+func (fi *FaultInjector) Add(fault *Fault) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.nextId++
+	fault.Id = fi.nextId
+	fault.seen = make(map[*Client]int)
+	fi.faults = append(fi.faults, fault)
+}
+
+// Delete removes a fault by id, or all of them if id is 0.
+func (fi *FaultInjector) Delete(id int) error {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	if id == 0 {
+		fi.faults = nil
+		return nil
+	}
+	for idx, fault := range fi.faults {
+		if fault.Id == id {
+			fi.faults = append(fi.faults[:idx], fi.faults[idx+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no fault %d", id)
+}
+
+func (fi *FaultInjector) Faults() []*Fault {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	return append([]*Fault(nil), fi.faults...)
+}
+
+// Load adds the faults of a file, one per line. Blank lines and lines
+// starting with # are ignored. Nothing is added if any line is invalid.
+func (fi *FaultInjector) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var faults []*Fault
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fault, err := ParseFault(text)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		faults = append(faults, fault)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, fault := range faults {
+		fi.Add(fault)
+	}
+	return nil
+}
+
+func (fi *FaultInjector) empty() bool {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	return len(fi.faults) == 0
+}
+
+// apply decides what happens to a decoded message: how long to hold it
+// back, whether to drop it, or whether to disconnect the client instead.
+func (fi *FaultInjector) apply(client *Client, packet *WaylandPacket, event bool) (time.Duration, bool, error) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	var delay time.Duration
+	for _, fault := range fi.faults {
+		if !clientMatches(fault.Client, client) || !fault.Match(packet, event) {
+			continue
+		}
+		if fault.Kind == "disconnect" {
+			if fault.seen[client] >= fault.After {
+				return 0, false, fmt.Errorf("disconnected by fault %d", fault.Id)
+			}
+			fault.seen[client]++
+			continue
+		}
+		if rand.Float64() >= fault.Probability {
+			continue
+		}
+		if fault.Kind == "drop" {
+			return 0, true, nil
+		}
+		d := fault.Delay
+		if fault.Jitter > 0 {
+			d += time.Duration(rand.Int63n(int64(2*fault.Jitter)+1)) - fault.Jitter
+		}
+		if d > 0 {
+			delay += d
+		}
+	}
+	return delay, false, nil
+}
+
+// injectFaults applies the faults of the proxy to a message about to be
+// recorded and passed on. It returns the message, or nil if it is dropped,
+// how long to hold it back, and an error if the client is to be
+// disconnected. The client lock must not be held.
+func (client *Client) injectFaults(packet *WaylandPacket, event bool) (*WaylandPacket, time.Duration, error) {
+	faults := &client.proxy.Faults
+	if faults.empty() {
+		return packet, 0, nil
+	}
+	client.lock.Lock()
+	if object, ok := client.ObjectMap[packet.ObjectId]; ok {
+		client.decode(object, packet, event)
+	}
+	client.lock.Unlock()
+
+	delay, drop, err := faults.apply(client, packet, event)
+	if err != nil {
+		return nil, 0, err
+	}
+	if drop {
+		return nil, 0, nil
+	}
+	return packet, delay, nil
+}
+
+// heldEvent is an event held back by a delay fault until due.
+type heldEvent struct {
+	due    time.Time
+	packet *WaylandPacket
+}
+
+// eventDelays holds back the delayed events of a client and passes them on
+// from a goroutine of its own, so that the events behind them are not held
+// up. Held events keep their order among themselves.
+type eventDelays struct {
+	lock    sync.Mutex
+	held    []heldEvent
+	wake    chan struct{}
+	running bool
+	closed  bool
+}
+
+// holdEvent passes an event on once delay has passed, and not before the
+// events held back before it.
+func (client *Client) holdEvent(packet *WaylandPacket, delay time.Duration) {
+	q := &client.delays
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		for _, fd := range packet.Fds {
+			unix.Close(int(fd))
+		}
+		return
+	}
+	due := time.Now().Add(delay)
+	if n := len(q.held); n > 0 && due.Before(q.held[n-1].due) {
+		due = q.held[n-1].due
+	}
+	q.held = append(q.held, heldEvent{due, packet})
+	if q.wake == nil {
+		q.wake = make(chan struct{}, 1)
+	}
+	if !q.running {
+		q.running = true
+		go client.releaseEvents()
+	}
+}
+
+// releaseEvents passes held events on as they become due, until none are
+// left.
+func (client *Client) releaseEvents() {
+	q := &client.delays
+	for {
+		q.lock.Lock()
+		if len(q.held) == 0 {
+			q.running = false
+			q.lock.Unlock()
+			return
+		}
+		next := q.held[0]
+		wait := time.Until(next.due)
+		if wait > 0 && !q.closed {
+			q.lock.Unlock()
+			select {
+			case <-time.After(wait):
+			case <-q.wake:
+			}
+			continue
+		}
+		q.held = q.held[1:]
+		closed := q.closed
+		q.lock.Unlock()
+
+		if closed {
+			for _, fd := range next.packet.Fds {
+				unix.Close(int(fd))
+			}
+			continue
+		}
+		next.packet.Timestamp = time.Now()
+		client.writeLock.Lock()
+		err := client.passEvent(next.packet)
+		client.writeLock.Unlock()
+		if err != nil {
+			client.Close(err)
+		}
+	}
+}
+
+// dropHeldEvents discards the held events of a closing client. It may be
+// called with the client lock held.
+func (client *Client) dropHeldEvents() {
+	q := &client.delays
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	if q.wake != nil {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// SendError sends a wl_display.error for an object to the client, then
+// closes the connection as a compositor would.
+func (client *Client) SendError(objectId uint32, code uint32, message string) error {
+	err := client.SendEvent(1, "error", objectId, code, message)
+	if err != nil {
+		return err
+	}
+	client.Close(fmt.Errorf("injected error %d on object %d: %s", code, objectId, message))
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Upper bounds of the commit interval histogram buckets, in milliseconds.
+// The last bucket holds everything longer.
+var frameIntervalBuckets = []int{8, 12, 17, 25, 34, 50, 100}
+
+// Number of recent samples averaged in FrameTiming
+const frameTimingWindow = 60
+
+// durationWindow keeps the most recent samples of a duration.
+type durationWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+func (w *durationWindow) add(d time.Duration) {
+	if len(w.samples) < frameTimingWindow {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % frameTimingWindow
+}
+
+func (w *durationWindow) mean() time.Duration {
+	if len(w.samples) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range w.samples {
+		sum += d
+	}
+	return sum / time.Duration(len(w.samples))
+}
+
+// FrameTiming follows the pace at which a surface is redrawn, from the
+// timestamps of its commits and frame callbacks.
+type FrameTiming struct {
+	Commits    uint32
+	LastCommit time.Time
+	// Commit intervals, bucketed by frameIntervalBuckets
+	Histogram [8]uint32
+	// Frames the surface could have presented while it was waiting on
+	// frame callbacks, judged by the refresh rate of its outputs
+	MissedFrames uint32
+	// Refresh period of the outputs of the surface at the last commit, 0
+	// if unknown
+	Refresh time.Duration
+
+	intervals    durationWindow
+	frameLatency durationWindow
+	doneToCommit durationWindow
+
+	// Time of the wl_surface.frame requests still waiting for done
+	frameRequests map[uint32]time.Time
+	// Set when a frame callback was requested since the last commit
+	frameRequested bool
+	// Set if the last commit came with a frame callback
+	animating bool
+	lastDone  time.Time
+}
+
+// FrameSample is the timing of a surface as of one of its commits.
+type FrameSample struct {
+	Surface  uint32
+	Commit   uint32
+	Interval time.Duration
+	// Averages over the most recent frames
+	FPS          float64
+	MeanInterval time.Duration
+	FrameLatency time.Duration
+	DoneToCommit time.Duration
+	// Frames missed by this commit, and in total
+	Missed       uint32
+	MissedFrames uint32
+	// Refresh period of the outputs of the surface, 0 if unknown
+	Refresh time.Duration
+	// Damaged percentage of the surface, or -1 if the commit brought no
+	// new buffer
+	Damage float64
+}
+
+func (t *FrameTiming) frame(callback uint32, now time.Time) {
+	if t.frameRequests == nil {
+		t.frameRequests = make(map[uint32]time.Time)
+	}
+	t.frameRequests[callback] = now
+	t.frameRequested = true
+}
+
+func (t *FrameTiming) done(callback uint32, now time.Time) {
+	if requested, ok := t.frameRequests[callback]; ok {
+		t.frameLatency.add(now.Sub(requested))
+		delete(t.frameRequests, callback)
+	}
+	t.lastDone = now
+}
+
+// commit records a commit at now. refresh is the refresh period of the
+// outputs of the surface, or 0 if unknown.
+func (t *FrameTiming) commit(surface uint32, now time.Time, refresh time.Duration) FrameSample {
+	var interval time.Duration
+	var missed uint32
+	if !t.LastCommit.IsZero() {
+		interval = now.Sub(t.LastCommit)
+		t.intervals.add(interval)
+		bucket := len(frameIntervalBuckets)
+		for idx, bound := range frameIntervalBuckets {
+			if interval < time.Duration(bound)*time.Millisecond {
+				bucket = idx
+				break
+			}
+		}
+		t.Histogram[bucket]++
+
+		// A client drawing in a frame callback loop should commit
+		// once per refresh; each refresh period in between is a frame
+		// it missed.
+		if t.animating && refresh > 0 {
+			if n := (interval + refresh/2) / refresh; n > 1 {
+				missed = uint32(n - 1)
+				t.MissedFrames += missed
+			}
+		}
+	}
+	if !t.lastDone.IsZero() {
+		t.doneToCommit.add(now.Sub(t.lastDone))
+		t.lastDone = time.Time{}
+	}
+	t.animating = t.frameRequested
+	t.frameRequested = false
+	t.LastCommit = now
+	t.Refresh = refresh
+	t.Commits++
+
+	return FrameSample{
+		Surface:      surface,
+		Commit:       t.Commits,
+		Interval:     interval,
+		FPS:          t.FPS(),
+		MeanInterval: t.intervals.mean(),
+		FrameLatency: t.frameLatency.mean(),
+		DoneToCommit: t.doneToCommit.mean(),
+		Missed:       missed,
+		MissedFrames: t.MissedFrames,
+		Refresh:      refresh,
+	}
+}
+
+// FPS returns the commit rate over the most recent frames.
+func (t *FrameTiming) FPS() float64 {
+	mean := t.intervals.mean()
+	if mean <= 0 {
+		return 0
+	}
+	return float64(time.Second) / float64(mean)
+}
+
+func formatMillis(d time.Duration) string {
+	return fmt.Sprintf("%.1f ms", float64(d)/float64(time.Millisecond))
+}
+
+// Details describes the timing for the dashboard.
+func (t *FrameTiming) Details() []string {
+	if t.Commits < 2 {
+		return nil
+	}
+	fps := fmt.Sprintf("%.1f fps", t.FPS())
+	if t.Refresh > 0 {
+		fps += fmt.Sprintf(" of %.1f Hz", float64(time.Second)/float64(t.Refresh))
+	}
+	summary := []string{
+		fps,
+		"interval " + formatMillis(t.intervals.mean()),
+	}
+	if len(t.frameLatency.samples) > 0 {
+		summary = append(summary, "frame→done "+formatMillis(t.frameLatency.mean()))
+	}
+	if len(t.doneToCommit.samples) > 0 {
+		summary = append(summary, "done→commit "+formatMillis(t.doneToCommit.mean()))
+	}
+	if t.MissedFrames > 0 {
+		summary = append(summary, fmt.Sprintf("missed: %d", t.MissedFrames))
+	}
+
+	var histogram []string
+	for idx, count := range t.Histogram {
+		if count == 0 {
+			continue
+		}
+		if idx < len(frameIntervalBuckets) {
+			histogram = append(histogram, fmt.Sprintf("<%dms: %d", frameIntervalBuckets[idx], count))
+		} else {
+			histogram = append(histogram, fmt.Sprintf("≥%dms: %d",
+				frameIntervalBuckets[len(frameIntervalBuckets)-1], count))
+		}
+	}
+	return []string{
+		"timing: " + strings.Join(summary, ", "),
+		"intervals: " + strings.Join(histogram, ", "),
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type headlessArg struct {
+	Name      string      `json:"name"`
+	Type      string      `json:"type"`
+	Interface string      `json:"interface,omitempty"`
+	Version   uint32      `json:"version,omitempty"`
+	Value     interface{} `json:"value"`
+}
+
+// headlessTiming is the frame timing of a surface as of a commit, with
+// durations in milliseconds.
+type headlessTiming struct {
+	Commit       uint32  `json:"commit"`
+	Interval     float64 `json:"interval"`
+	FPS          float64 `json:"fps"`
+	MeanInterval float64 `json:"mean_interval"`
+	FrameLatency float64 `json:"frame_latency"`
+	DoneToCommit float64 `json:"done_to_commit"`
+	Missed       uint32  `json:"missed"`
+	MissedFrames uint32  `json:"missed_total"`
+	// Refresh period of the outputs of the surface, if known
+	RefreshPeriod float64 `json:"refresh_period,omitempty"`
+	// Percentage, for commits bringing a new buffer
+	Damage *float64 `json:"damage,omitempty"`
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// headlessRecord is one line of headless output. Type is one of "connect",
+// "disconnect", "create", "destroy", "message", "frame" or "problem".
+type headlessRecord struct {
+	Type      string        `json:"type"`
+	Time      string        `json:"time"`
+	Client    uint32        `json:"client"`
+	Pid       int32         `json:"pid"`
+	Direction string        `json:"direction,omitempty"`
+	Object    uint32        `json:"object,omitempty"`
+	Interface string        `json:"interface,omitempty"`
+	Opcode    *uint16       `json:"opcode,omitempty"`
+	Name      string        `json:"name,omitempty"`
+	Args      []headlessArg `json:"args,omitempty"`
+	Fds       int           `json:"fds,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	// Set for frame records, which follow the commit of Object
+	Timing *headlessTiming `json:"timing,omitempty"`
+	// Set for problem records: "client" or "compositor", and what went
+	// wrong
+	Party   string `json:"party,omitempty"`
+	Problem string `json:"problem,omitempty"`
+}
+
+// Headless streams decoded traffic and client lifecycle events as JSON
+// lines instead of running the dashboard.
+type Headless struct {
+	enc  *json.Encoder
+	lock sync.Mutex
+}
+
+func NewHeadless(proxy *Proxy, w io.Writer) *Headless {
+	h := &Headless{
+		enc: json.NewEncoder(w),
+	}
+	proxy.OnConnect(func(c *Client) {
+		h.emit(c, headlessRecord{Type: "connect"}, c.Timestamp)
+	})
+	proxy.OnDisconnect(func(c *Client) {
+		rec := headlessRecord{Type: "disconnect"}
+		if c.Err != nil && c.Err != io.EOF {
+			rec.Error = c.Err.Error()
+		}
+		h.emit(c, rec, c.Timestamp)
+	})
+	proxy.OnObjectCreate(func(c *Client, obj *WaylandObject) {
+		h.emit(c, headlessRecord{
+			Type:      "create",
+			Object:    obj.ObjectId,
+			Interface: obj.Interface,
+		}, c.packetTime)
+	})
+	proxy.OnObjectDestroy(func(c *Client, obj *WaylandObject) {
+		h.emit(c, headlessRecord{
+			Type:      "destroy",
+			Object:    obj.ObjectId,
+			Interface: obj.Interface,
+		}, c.packetTime)
+	})
+	proxy.OnPacket(func(c *Client, packet *WaylandPacket, event bool) {
+		h.emit(c, headlessMessage(packet, event), packet.Timestamp)
+	})
+	proxy.OnFrame(func(c *Client, sample FrameSample) {
+		timing := &headlessTiming{
+			Commit:        sample.Commit,
+			Interval:      millis(sample.Interval),
+			FPS:           sample.FPS,
+			MeanInterval:  millis(sample.MeanInterval),
+			FrameLatency:  millis(sample.FrameLatency),
+			DoneToCommit:  millis(sample.DoneToCommit),
+			Missed:        sample.Missed,
+			MissedFrames:  sample.MissedFrames,
+			RefreshPeriod: millis(sample.Refresh),
+		}
+		if sample.Damage >= 0 {
+			timing.Damage = &sample.Damage
+		}
+		h.emit(c, headlessRecord{
+			Type:      "frame",
+			Object:    sample.Surface,
+			Interface: "wl_surface",
+			Timing:    timing,
+		}, c.packetTime)
+	})
+	proxy.OnProblem(func(c *Client, p *Problem) {
+		rec := headlessRecord{
+			Type:    "problem",
+			Party:   p.Party(),
+			Problem: p.Message,
+		}
+		if p.Object != nil {
+			rec.Object = p.Object.ObjectId
+			rec.Interface = p.Object.Interface
+		}
+		h.emit(c, rec, p.Time)
+	})
+	return h
+}
+
+func headlessMessage(packet *WaylandPacket, event bool) headlessRecord {
+	opcode := packet.Opcode
+	rec := headlessRecord{
+		Type:      "message",
+		Direction: "request",
+		Object:    packet.ObjectId,
+		Interface: packet.Interface,
+		Opcode:    &opcode,
+		Fds:       len(packet.Fds),
+	}
+	if event {
+		rec.Direction = "event"
+	}
+	if packet.Message != nil {
+		rec.Name = packet.Message.Name
+	}
+	for _, arg := range packet.Args {
+		a := headlessArg{
+			Name:    arg.Name,
+			Type:    arg.Type,
+			Version: arg.Version,
+			Value:   arg.Value,
+		}
+		switch arg.Type {
+		case "object", "new_id":
+			a.Interface = arg.Interface
+		case "fixed":
+			a.Value = arg.Value.(WaylandFixed).ToDouble()
+		}
+		if arg.Null {
+			a.Value = nil
+		}
+		rec.Args = append(rec.Args, a)
+	}
+	return rec
+}
+
+func (h *Headless) emit(c *Client, rec headlessRecord, t time.Time) {
+	rec.Time = t.Format(time.RFC3339Nano)
+	rec.Client = c.id
+	rec.Pid = c.pid
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.enc.Encode(rec)
+}
+
+// waitHeadless blocks until the command launched by wlhax has exited and its
+// connections have closed, or until wlhax is interrupted. Offline proxies
+// have nothing to wait for.
+func waitHeadless(proxy *Proxy, cmd *exec.Cmd) {
+	if proxy.Offline() {
+		return
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	if cmd != nil {
+		go func() {
+			cmd.Wait()
+			close(done)
+		}()
+	}
+
+	select {
+	case <-sigs:
+		return
+	case <-done:
+	}
+
+	// Give the proxy loops a moment to notice the connections closing
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		connected := false
+		for _, client := range proxy.Clients {
+			if client.Err == nil {
+				connected = true
+			}
+		}
+		if !connected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
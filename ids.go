@@ -0,0 +1,193 @@
+package main
+
+import "encoding/binary"
+
+// Highest id of the client-allocated range. wlhax allocates ids for its own
+// objects downwards from here, far from where clients start counting.
+const maxClientId = 0xfeffffff
+
+// IdMap translates object ids between the client and compositor sides of a
+// connection. Both sides use the same ids until wlhax injects a request
+// creating an object: such objects only exist on the compositor side, and a
+// client object that would collide with one is given another id there. The
+// object model always uses compositor-side ids.
+type IdMap struct {
+	toRemote map[uint32]uint32
+	toClient map[uint32]uint32
+	// Compositor-side ids of objects created by wlhax
+	injected map[uint32]bool
+	next     uint32
+}
+
+func (m *IdMap) active() bool {
+	return len(m.injected) > 0 || len(m.toRemote) > 0
+}
+
+func (m *IdMap) remote(id uint32) uint32 {
+	if r, ok := m.toRemote[id]; ok {
+		return r
+	}
+	return id
+}
+
+func (m *IdMap) local(id uint32) uint32 {
+	if l, ok := m.toClient[id]; ok {
+		return l
+	}
+	return id
+}
+
+// taken reports whether a compositor-side id is used by an object the
+// client does not know under that id.
+func (m *IdMap) taken(id uint32) bool {
+	_, remapped := m.toClient[id]
+	return m.injected[id] || remapped
+}
+
+// allocate returns a compositor-side id for a new object, which must not be
+// in inUse.
+func (m *IdMap) allocate(inUse map[uint32]*WaylandObject) uint32 {
+	if m.next == 0 {
+		m.next = maxClientId
+	}
+	for {
+		id := m.next
+		m.next--
+		if _, ok := inUse[id]; !ok && !m.taken(id) {
+			return id
+		}
+	}
+}
+
+// Inject allocates the id of an object wlhax creates on behalf of the
+// client. The client lock must be held.
+func (client *Client) Inject() uint32 {
+	if client.ids.injected == nil {
+		client.ids.injected = make(map[uint32]bool)
+		client.ids.toRemote = make(map[uint32]uint32)
+		client.ids.toClient = make(map[uint32]uint32)
+	}
+	id := client.ids.allocate(client.ObjectMap)
+	client.ids.injected[id] = true
+	return id
+}
+
+// uninject gives back an id allocated with Inject for an object that was
+// never created. The client lock must be held.
+func (client *Client) uninject(id uint32) {
+	delete(client.ids.injected, id)
+	if id == client.ids.next+1 {
+		client.ids.next = id
+	}
+}
+
+// rewriteIds re-encodes the object and new_id arguments of a packet through
+// mapId, and returns a copy if anything changed.
+func (client *Client) rewriteIds(packet *WaylandPacket, event bool, mapId func(arg WaylandArgument) uint32) *WaylandPacket {
+	object, ok := client.ObjectMap[packet.ObjectId]
+	if !ok {
+		return packet
+	}
+	msg := client.protocols.Message(object.Interface, packet.Opcode, event)
+	if msg == nil {
+		return packet
+	}
+	args, err := DecodeArguments(packet, msg)
+	if err != nil {
+		return packet
+	}
+	changed := false
+	for idx := range args {
+		arg := &args[idx]
+		if (arg.Type != "object" && arg.Type != "new_id") || arg.Null {
+			continue
+		}
+		if id := mapId(*arg); id != arg.Value.(uint32) {
+			arg.Value = id
+			changed = true
+		}
+	}
+	if !changed {
+		return packet
+	}
+	payload, err := EncodeArguments(args)
+	if err != nil {
+		return packet
+	}
+	out := *packet
+	out.Arguments = payload
+	out.Length = uint16(len(payload) + 8)
+	out.Reset()
+	return &out
+}
+
+// translateRequest turns a request read from the client into compositor-side
+// ids, giving new objects another id if theirs is taken by wlhax. The client
+// lock must be held.
+func (client *Client) translateRequest(packet *WaylandPacket) *WaylandPacket {
+	m := &client.ids
+	if !m.active() {
+		return packet
+	}
+	packet.ObjectId = m.remote(packet.ObjectId)
+	return client.rewriteIds(packet, false, func(arg WaylandArgument) uint32 {
+		id := arg.Value.(uint32)
+		if arg.Type == "object" {
+			return m.remote(id)
+		}
+		if !m.taken(id) {
+			return id
+		}
+		remote := m.allocate(client.ObjectMap)
+		m.toRemote[id] = remote
+		m.toClient[remote] = id
+		return remote
+	})
+}
+
+// translateEvent turns an event into client-side ids before it is recorded.
+// It returns nil if the event concerns an object the client does not know
+// about. The client lock must be held.
+func (client *Client) translateEvent(packet *WaylandPacket) *WaylandPacket {
+	m := &client.ids
+	if !m.active() {
+		return packet
+	}
+	if m.injected[packet.ObjectId] {
+		return nil
+	}
+	if packet.ObjectId == 1 && packet.Opcode == 1 { // wl_display.delete_id
+		p := &WaylandPacket{Arguments: packet.Arguments}
+		p.Reset()
+		id, err := p.ReadUint32()
+		if err != nil {
+			return packet
+		}
+		if m.injected[id] {
+			delete(m.injected, id)
+			return nil
+		}
+		local, ok := m.toClient[id]
+		if !ok {
+			return packet
+		}
+		delete(m.toClient, id)
+		delete(m.toRemote, local)
+		out := *packet
+		out.Arguments = binary.LittleEndian.AppendUint32(nil, local)
+		out.Reset()
+		return &out
+	}
+
+	out := client.rewriteIds(packet, true, func(arg WaylandArgument) uint32 {
+		return m.local(arg.Value.(uint32))
+	})
+	if local := m.local(packet.ObjectId); local != packet.ObjectId {
+		if out == packet {
+			copied := *packet
+			out = &copied
+		}
+		out.ObjectId = local
+	}
+	return out
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// splitMessageText splits a hand-written message into words, keeping
+// "quoted strings" and [array items] together.
+func splitMessageText(text string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord, quoted, bracketed := false, false, false
+	for idx := 0; idx < len(text); idx++ {
+		c := text[idx]
+		switch {
+		case quoted:
+			if c == '\\' && idx+1 < len(text) {
+				word.WriteByte(c)
+				idx++
+				c = text[idx]
+			} else if c == '"' {
+				quoted = false
+			}
+		case bracketed:
+			bracketed = c != ']'
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		case c == '"':
+			quoted = true
+		case c == '[':
+			bracketed = true
+		}
+		word.WriteByte(c)
+		inWord = true
+	}
+	if quoted {
+		return nil, errors.New("unterminated string")
+	}
+	if bracketed {
+		return nil, errors.New("unterminated array")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func messageSignature(iface string, msg *ProtocolMessage) string {
+	var args []string
+	for _, arg := range msg.Args {
+		args = append(args, arg.Type+" "+arg.Name)
+	}
+	return fmt.Sprintf("%s.%s(%s)", iface, msg.Name, strings.Join(args, ", "))
+}
+
+// enumValue resolves a name (or names joined with |, for bitfields) to the
+// value of an enum of iface. An empty enum searches every enum of iface.
+func (set *ProtocolSet) enumValue(iface, enum, name string) (uint32, bool) {
+	if i, e, ok := strings.Cut(enum, "."); ok {
+		iface, enum = i, e
+	}
+	protoIface := set.Interface(iface)
+	if protoIface == nil {
+		return 0, false
+	}
+
+	var value uint32
+	for _, part := range strings.Split(name, "|") {
+		found := false
+		for _, e := range protoIface.Enums {
+			if enum != "" && e.Name != enum {
+				continue
+			}
+			for _, entry := range e.Entries {
+				if entry.Name == part {
+					value |= entry.Value
+					found = true
+					break
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			return 0, false
+		}
+	}
+	return value, true
+}
+
+// parseArgument converts one word of a hand-written message to a value for
+// NewPacket.
+func (set *ProtocolSet) parseArgument(iface string, spec ProtocolArg, word string) (interface{}, error) {
+	if word == "nil" || word == "null" {
+		return nil, nil
+	}
+	invalid := fmt.Errorf("%s: invalid %s %s", spec.Name, spec.Type, word)
+	switch spec.Type {
+	case "int":
+		if v, err := strconv.ParseInt(word, 0, 32); err == nil {
+			return int32(v), nil
+		}
+		if v, ok := set.enumValue(iface, spec.Enum, word); ok {
+			return int32(v), nil
+		}
+	case "uint":
+		if v, err := strconv.ParseUint(word, 0, 32); err == nil {
+			return uint32(v), nil
+		}
+		if v, ok := set.enumValue(iface, spec.Enum, word); ok {
+			return v, nil
+		}
+	case "fixed":
+		if v, err := strconv.ParseFloat(word, 64); err == nil {
+			return v, nil
+		}
+	case "string":
+		if strings.HasPrefix(word, `"`) {
+			s, err := strconv.Unquote(word)
+			if err != nil {
+				return nil, invalid
+			}
+			return s, nil
+		}
+		return word, nil
+	case "object", "new_id":
+		var objectIface string
+		if idx := strings.IndexByte(word, '@'); idx >= 0 {
+			objectIface, word = word[:idx], word[idx+1:]
+		}
+		if spec.Type == "new_id" && spec.Interface == "" {
+			// Untyped new_ids are written interface@id:version
+			idText, versionText, _ := strings.Cut(word, ":")
+			id, err := strconv.ParseUint(idText, 10, 32)
+			version, verr := strconv.ParseUint(versionText, 10, 32)
+			if err != nil || verr != nil || objectIface == "" {
+				return nil, fmt.Errorf("%s: expected interface@id:version", spec.Name)
+			}
+			return WaylandArgument{
+				Interface: objectIface,
+				Version:   uint32(version),
+				Value:     uint32(id),
+			}, nil
+		}
+		if v, err := strconv.ParseUint(word, 10, 32); err == nil {
+			return uint32(v), nil
+		}
+	case "array":
+		// Items are uint32 numbers or names of enum entries of the
+		// interface, as in xdg_toplevel.configure states.
+		if !strings.HasPrefix(word, "[") || !strings.HasSuffix(word, "]") {
+			return nil, invalid
+		}
+		items := strings.FieldsFunc(word[1:len(word)-1], func(r rune) bool {
+			return r == ' ' || r == ','
+		})
+		array := make([]byte, 4*len(items))
+		for idx, item := range items {
+			v, err := strconv.ParseUint(item, 0, 32)
+			if err != nil {
+				v32, ok := set.enumValue(iface, "", item)
+				if !ok {
+					return nil, invalid
+				}
+				v = uint64(v32)
+			}
+			binary.LittleEndian.PutUint32(array[4*idx:], uint32(v))
+		}
+		return array, nil
+	case "fd":
+		// - stands for the original fd when editing a paused message,
+		// anything else is a file to open and pass read-only
+		if word == "-" {
+			return -1, nil
+		}
+		fd, err := unix.Open(word, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", spec.Name, err)
+		}
+		return fd, nil
+	}
+	return nil, invalid
+}
+
+// newIdArgument allocates the object created by an injected request. Untyped
+// new_ids, as in wl_registry.bind, are written new:interface:version.
+func (client *Client) newIdArgument(spec ProtocolArg, word string) (interface{}, error) {
+	if spec.Interface != "" {
+		return client.Inject(), nil
+	}
+	parts := strings.Split(word, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%s: expected new:interface:version", spec.Name)
+	}
+	version, err := strconv.ParseUint(parts[2], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid version %s", spec.Name, parts[2])
+	}
+	return WaylandArgument{
+		Interface: parts[1],
+		Version:   uint32(version),
+		Value:     client.Inject(),
+	}, nil
+}
+
+func isNewIdWord(word string) bool {
+	return word == "new" || strings.HasPrefix(word, "new:")
+}
+
+// ParseMessage builds a packet from a hand-written message of the form
+//
+//	interface@id message [args...]
+//
+// Numbers may be replaced by enum entry names, strings may be quoted,
+// arrays are written as [item ...] and fds as the path of a file to pass.
+// In requests, "new" allocates the id of a new_id argument. Fds written as
+// - are left as ^uintptr(0) for EditPaused. The packet's fds are closed by
+// WriteEvent and WriteRequest.
+func (client *Client) ParseMessage(text string, event bool) (*WaylandPacket, error) {
+	words, err := splitMessageText(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) < 2 {
+		return nil, errors.New("expected interface@id message [args...]")
+	}
+	iface, idText, ok := strings.Cut(words[0], "@")
+	if !ok {
+		iface, idText = "", words[0]
+	}
+	id, err := strconv.ParseUint(idText, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object %s", words[0])
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	object, msg, err := client.lookupMessage(uint32(id), words[1], event)
+	if err != nil {
+		return nil, err
+	}
+	if iface != "" && iface != object.Interface {
+		return nil, fmt.Errorf("%d is %s, not %s", id, object, iface)
+	}
+	if len(words)-2 != len(msg.Args) {
+		return nil, fmt.Errorf("usage: %s", messageSignature(object.Interface, msg))
+	}
+
+	values := make([]interface{}, len(msg.Args))
+	for idx, word := range words[2:] {
+		if !event && msg.Args[idx].Type == "new_id" && isNewIdWord(word) {
+			continue
+		}
+		values[idx], err = client.protocols.parseArgument(object.Interface, msg.Args[idx], word)
+		if err != nil {
+			closeFdValues(values)
+			return nil, err
+		}
+	}
+	// Only allocate ids once everything else is known to be valid, and give
+	// them back if the message still turns out to be invalid
+	var injected []uint32
+	fail := func(err error) (*WaylandPacket, error) {
+		closeFdValues(values)
+		for idx := len(injected) - 1; idx >= 0; idx-- {
+			client.uninject(injected[idx])
+		}
+		return nil, err
+	}
+	for idx, word := range words[2:] {
+		if !event && msg.Args[idx].Type == "new_id" && isNewIdWord(word) {
+			values[idx], err = client.newIdArgument(msg.Args[idx], word)
+			if err != nil {
+				return fail(err)
+			}
+			switch v := values[idx].(type) {
+			case uint32:
+				injected = append(injected, v)
+			case WaylandArgument:
+				injected = append(injected, v.Value.(uint32))
+			}
+		}
+	}
+	packet, err := client.NewPacket(uint32(id), msg.Name, event, values...)
+	if err != nil {
+		return fail(err)
+	}
+	return packet, nil
+}
+
+func closeFdValues(values []interface{}) {
+	for _, v := range values {
+		if fd, ok := v.(int); ok && fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+}
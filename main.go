@@ -1,42 +1,132 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 
 	"github.com/dwapp/wlhax/ui"
 )
 
+type pathList []string
+
+func (l *pathList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *pathList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
-	remoteDisplay, ok := os.LookupEnv("WAYLAND_DISPLAY")
-	if !ok {
-		panic("No WAYLAND_DISPLAY set")
-	}
+	var protocolPaths pathList
+	flag.Var(&protocolPaths, "protocols",
+		"protocol XML file or directory to load (may be repeated)")
+	capturePath := flag.String("capture", "",
+		"record all proxied traffic to a capture file")
+	pcapPath := flag.String("pcap", "",
+		"export all proxied traffic to a pcapng file")
+	headless := flag.Bool("headless", false,
+		"print decoded traffic as JSON lines instead of running the UI")
+	synthetic := flag.Bool("synthetic", false,
+		"act as a minimal compositor instead of proxying to WAYLAND_DISPLAY")
+	globals := flag.String("globals", defaultSyntheticGlobals,
+		"globals advertised in synthetic mode, as interface:version pairs separated by commas")
+	rulesPath := flag.String("rules", "",
+		"load rules rewriting proxied messages from a file")
+	faultsPath := flag.String("faults", "",
+		"load faults to inject into proxied traffic from a file")
+	flag.Parse()
 
-	var (
-		err   error
-		path  string
-		proxy *Proxy
-	)
-	for idx := 0; idx < 10; idx++ {
-		path = fmt.Sprintf("wlhax-%d", idx)
-		if proxy, err = NewProxy(path, remoteDisplay); err == nil {
-			break
-		}
-	}
+	protocols, err := LoadProtocols(protocolPaths)
 	if err != nil {
 		panic(err)
 	}
-	defer os.Remove(path)
+
+	args := flag.Args()
+	if len(args) >= 2 && args[0] == "replay" {
+		os.Exit(runReplay(args[1:], protocols))
+	}
+
+	var proxy *Proxy
+	if len(args) == 2 && args[0] == "open" {
+		proxy = NewOfflineProxy(args[1])
+		proxy.Protocols = protocols
+	} else {
+		var server *SyntheticServer
+		remoteDisplay, ok := os.LookupEnv("WAYLAND_DISPLAY")
+		if *synthetic {
+			if server, err = NewSyntheticServer(*globals); err != nil {
+				panic(err)
+			}
+		} else if !ok {
+			panic("No WAYLAND_DISPLAY set")
+		}
+
+		var path string
+		for idx := 0; idx < 10; idx++ {
+			path = fmt.Sprintf("wlhax-%d", idx)
+			if proxy, err = NewProxy(path, remoteDisplay); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			panic(err)
+		}
+		defer os.Remove(path)
+		proxy.Protocols = protocols
+		proxy.Synthetic = server
+
+		if *capturePath != "" {
+			if proxy.Capture, err = NewCaptureWriter(*capturePath); err != nil {
+				panic(err)
+			}
+		}
+		if *pcapPath != "" {
+			if err = proxy.StartPcap(*pcapPath); err != nil {
+				panic(err)
+			}
+		}
+		if *rulesPath != "" {
+			if err = proxy.Rules.Load(*rulesPath, protocols); err != nil {
+				panic(err)
+			}
+		}
+		if *faultsPath != "" {
+			if err = proxy.Faults.Load(*faultsPath); err != nil {
+				panic(err)
+			}
+		}
+	}
 	defer proxy.Close()
 
-	dash := NewDashboard(proxy)
-	go proxy.Run()
+	var dash *Dashboard
+	if *headless {
+		NewHeadless(proxy, os.Stdout)
+	} else {
+		dash = NewDashboard(proxy)
+	}
+
+	var cmd *exec.Cmd
+	if proxy.Offline() {
+		if err := proxy.LoadCapture(args[1]); err != nil {
+			panic(err)
+		}
+	} else {
+		go proxy.Run()
+
+		if len(args) > 0 {
+			cmd = exec.Command(args[0], args[1:]...)
+			cmd.Start()
+		}
+	}
 
-	if len(os.Args) > 1 {
-		cmd := exec.Command(os.Args[1], os.Args[2:]...)
-		cmd.Start()
+	if *headless {
+		waitHeadless(proxy, cmd)
+		return
 	}
 
 	err = ui.Initialize(dash)
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"git.sr.ht/~rockorager/vaxis"
+	"github.com/dwapp/wlhax/ui"
+)
+
+type packetLogEntry struct {
+	Packet *WaylandPacket
+	Event  bool
+}
+
+// PacketLogView shows the requests and events of one client merged into a
+// single chronological log, like WAYLAND_DEBUG=1 output.
+type PacketLogView struct {
+	client         *Client
+	entries        []packetLogEntry
+	rxSeen, txSeen int
+	// -1 follows the end of the log without showing a hex dump
+	selected       int
+	scroll         int
+	viewportHeight int
+}
+
+func NewPacketLogView(client *Client) *PacketLogView {
+	return &PacketLogView{
+		client:   client,
+		selected: -1,
+	}
+}
+
+// update merges packets logged since the last call into entries.
+func (view *PacketLogView) update() {
+	client := view.client
+	client.lock.RLock()
+	rx := client.RxLog[view.rxSeen:]
+	tx := client.TxLog[view.txSeen:]
+	view.rxSeen += len(rx)
+	view.txSeen += len(tx)
+	client.lock.RUnlock()
+
+	for len(rx) > 0 || len(tx) > 0 {
+		if len(tx) == 0 || (len(rx) > 0 && rx[0].Timestamp.Before(tx[0].Timestamp)) {
+			view.entries = append(view.entries, packetLogEntry{rx[0], true})
+			rx = rx[1:]
+		} else {
+			view.entries = append(view.entries, packetLogEntry{tx[0], false})
+			tx = tx[1:]
+		}
+	}
+}
+
+func formatPacketLogEntry(entry packetLogEntry) string {
+	dir := "->"
+	if entry.Event {
+		dir = "<-"
+	}
+	s := fmt.Sprintf("%s %s %s", entry.Packet.Timestamp.Format("15:04:05.000000"),
+		dir, entry.Packet)
+	if n := len(entry.Packet.Fds); n > 0 {
+		s += fmt.Sprintf(" fds: %d", n)
+	}
+	return s
+}
+
+func (view *PacketLogView) Draw(ctx *ui.Context) {
+	view.update()
+	ctx.Fill(0, 0, ctx.Width(), ctx.Height(), ' ', vaxis.Style{})
+
+	var dump []string
+	if view.selected >= 0 && view.selected < len(view.entries) {
+		packet := view.entries[view.selected].Packet
+		dump = strings.Split(strings.TrimRight(hex.Dump(packet.Arguments), "\n"), "\n")
+		if len(dump) > ctx.Height()/2 {
+			dump = dump[:ctx.Height()/2]
+		}
+	}
+
+	height := ctx.Height()
+	if len(dump) > 0 {
+		height -= len(dump) + 1
+	}
+	view.viewportHeight = height
+
+	if view.selected < 0 {
+		view.scroll = len(view.entries) - height
+	} else {
+		if view.selected < view.scroll {
+			view.scroll = view.selected
+		}
+		if view.selected >= view.scroll+height {
+			view.scroll = view.selected - height + 1
+		}
+	}
+	if view.scroll < 0 {
+		view.scroll = 0
+	}
+
+	for y := 0; y < height && view.scroll+y < len(view.entries); y++ {
+		idx := view.scroll + y
+		entry := view.entries[idx]
+		style := vaxis.Style{}
+		if entry.Event {
+			style.Foreground = vaxis.IndexColor(109)
+		}
+		if idx == view.selected {
+			style.Attribute = vaxis.AttrReverse
+		}
+		w := ctx.Printf(0, y, style, "%s", formatPacketLogEntry(entry))
+		ctx.Fill(w, y, ctx.Width()-w, 1, ' ', style)
+	}
+
+	if len(dump) > 0 {
+		y := height
+		sep := vaxis.Style{Foreground: vaxis.IndexColor(226)}
+		w := ctx.Printf(0, y, sep, "payload: %d bytes", len(view.entries[view.selected].Packet.Arguments))
+		ctx.Fill(w, y, ctx.Width()-w, 1, ' ', sep)
+		for i, line := range dump {
+			ctx.Printf(0, y+1+i, vaxis.Style{}, "%s", line)
+		}
+	}
+}
+
+func (view *PacketLogView) Invalidate() {
+	ui.Invalidate()
+}
+
+func (view *PacketLogView) SelectNext(inc int) {
+	if view.selected < 0 {
+		return
+	}
+	view.selected += inc
+	if view.selected >= len(view.entries) {
+		view.selected = len(view.entries) - 1
+	}
+	view.Invalidate()
+}
+
+func (view *PacketLogView) SelectPrev(inc int) {
+	if view.selected < 0 {
+		view.selected = len(view.entries)
+	}
+	view.selected -= inc
+	if view.selected < 0 {
+		view.selected = 0
+	}
+	view.Invalidate()
+}
+
+// Follow deselects the current line and keeps the end of the log in view.
+func (view *PacketLogView) Follow() {
+	view.selected = -1
+	view.Invalidate()
+}
+
+func (view *PacketLogView) Focus(focus bool) {
+	// This space deliberately left blank
+}
+
+func (view *PacketLogView) Event(event vaxis.Event) bool {
+	if key, ok := event.(vaxis.Key); ok {
+		switch {
+		case key.Matches(vaxis.KeyDown), key.Matches('j'):
+			view.SelectNext(1)
+			return true
+		case key.Matches(vaxis.KeyUp), key.Matches('k'):
+			view.SelectPrev(1)
+			return true
+		case key.Matches(vaxis.KeyPgDown):
+			view.SelectNext(view.viewportHeight)
+			return true
+		case key.Matches(vaxis.KeyPgUp):
+			view.SelectPrev(view.viewportHeight)
+			return true
+		case key.Matches('g'):
+			view.SelectPrev(len(view.entries))
+			return true
+		case key.Matches('G'), key.Matches(vaxis.KeyEsc):
+			view.Follow()
+			return true
+		}
+	}
+	return false
+}
+
+func (view *PacketLogView) MouseEvent(localX int, localY int, event vaxis.Event) {
+	mouse, ok := event.(vaxis.Mouse)
+	if !ok || mouse.EventType != vaxis.EventPress {
+		return
+	}
+
+	switch mouse.Button {
+	case vaxis.MouseWheelUp:
+		view.SelectPrev(3)
+	case vaxis.MouseWheelDown:
+		view.SelectNext(3)
+	case vaxis.MouseLeftButton:
+		line := view.scroll + localY
+		if localY >= view.viewportHeight || line >= len(view.entries) {
+			return
+		}
+		view.selected = line
+		view.Invalidate()
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ArgPredicate compares a decoded argument with a value. Numeric arguments
+// are compared as numbers, everything else as text; ~ tests whether the
+// argument contains the value.
+type ArgPredicate struct {
+	Name  string
+	Op    string
+	Value string
+}
+
+var argPredicateRegexp = regexp.MustCompile(`^([A-Za-z_0-9]+)(==|!=|<=|>=|=|<|>|~)(.*)$`)
+
+func (p ArgPredicate) String() string {
+	return p.Name + p.Op + p.Value
+}
+
+func (p ArgPredicate) Match(args []WaylandArgument) bool {
+	for _, arg := range args {
+		if arg.Name == p.Name {
+			return p.matchArg(arg)
+		}
+	}
+	return false
+}
+
+func (p ArgPredicate) matchArg(arg WaylandArgument) bool {
+	var text string
+	var number float64
+	numeric := false
+	switch v := arg.Value.(type) {
+	case int32:
+		number, numeric = float64(v), true
+	case uint32:
+		number, numeric = float64(v), true
+	case WaylandFixed:
+		number, numeric = v.ToDouble(), true
+	case string:
+		text = v
+	default:
+		text = arg.String()
+	}
+	if arg.Null {
+		numeric, text = false, "nil"
+	}
+
+	if p.Op == "~" {
+		if numeric {
+			text = strconv.FormatFloat(number, 'f', -1, 64)
+		}
+		return strings.Contains(text, p.Value)
+	}
+
+	var cmp int
+	if value, err := strconv.ParseFloat(p.Value, 64); numeric && err == nil {
+		switch {
+		case number < value:
+			cmp = -1
+		case number > value:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(text, p.Value)
+	}
+	switch p.Op {
+	case "=", "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// MessagePattern selects messages by direction, interface, object, message
+// name and arguments. Empty fields match anything.
+type MessagePattern struct {
+	// "request", "event" or empty for both
+	Direction  string
+	Interface  string
+	Message    string
+	ObjectId   uint32
+	Predicates []ArgPredicate
+}
+
+// ParseMessagePattern parses
+//
+//	[request|event] [interface][@id][.message] [arg<op>value...]
+//
+// where * stands for any interface or message.
+func ParseMessagePattern(words []string) (MessagePattern, error) {
+	var mp MessagePattern
+	if len(words) > 0 && (words[0] == "request" || words[0] == "event") {
+		mp.Direction = words[0]
+		words = words[1:]
+	}
+	if len(words) > 0 && !argPredicateRegexp.MatchString(words[0]) {
+		pattern := words[0]
+		words = words[1:]
+		if left, msg, ok := strings.Cut(pattern, "."); ok {
+			pattern, mp.Message = left, msg
+		}
+		iface, id, ok := strings.Cut(pattern, "@")
+		if ok {
+			oid, err := strconv.ParseUint(id, 10, 32)
+			if err != nil {
+				return mp, fmt.Errorf("invalid object id %s", id)
+			}
+			mp.ObjectId = uint32(oid)
+		}
+		if iface != "*" {
+			mp.Interface = iface
+		}
+		if mp.Message == "*" {
+			mp.Message = ""
+		}
+	}
+	for _, word := range words {
+		m := argPredicateRegexp.FindStringSubmatch(word)
+		if m == nil {
+			return mp, fmt.Errorf("invalid argument predicate %s", word)
+		}
+		mp.Predicates = append(mp.Predicates, ArgPredicate{m[1], m[2], m[3]})
+	}
+	return mp, nil
+}
+
+func (mp MessagePattern) String() string {
+	pattern := mp.Interface
+	if pattern == "" {
+		pattern = "*"
+	}
+	if mp.ObjectId != 0 {
+		pattern += fmt.Sprintf("@%d", mp.ObjectId)
+	}
+	if mp.Message != "" {
+		pattern += "." + mp.Message
+	}
+	var parts []string
+	if mp.Direction != "" {
+		parts = append(parts, mp.Direction)
+	}
+	parts = append(parts, pattern)
+	for _, p := range mp.Predicates {
+		parts = append(parts, p.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// Match tests a decoded packet against the pattern.
+func (mp MessagePattern) Match(packet *WaylandPacket, event bool) bool {
+	if (mp.Direction == "event") != event && mp.Direction != "" {
+		return false
+	}
+	if mp.Interface != "" && mp.Interface != packet.Interface {
+		return false
+	}
+	if mp.ObjectId != 0 && mp.ObjectId != packet.ObjectId {
+		return false
+	}
+	if mp.Message != "" && (packet.Message == nil || mp.Message != packet.Message.Name) {
+		return false
+	}
+	for _, p := range mp.Predicates {
+		if !p.Match(packet.Args) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// pcapng block types, option codes and flags, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+const (
+	pcapngSectionHeader     = 0x0A0D0D0A
+	pcapngInterfaceDesc     = 0x00000001
+	pcapngEnhancedPacket    = 0x00000006
+	pcapngByteOrderMagic    = 0x1A2B3C4D
+	pcapngOptEnd            = 0
+	pcapngOptComment        = 1
+	pcapngOptIfName         = 2
+	pcapngOptIfDescription  = 3
+	pcapngOptIfTsresol      = 9
+	pcapngOptShbUserAppl    = 4
+	pcapngOptEpbFlags       = 2
+	pcapngFlagInbound       = 1
+	pcapngFlagOutbound      = 2
+	pcapngSnapLen           = 0
+	pcapngTsresolNanosecond = 9
+)
+
+// There is no link type for Unix socket traffic, so packets are written as
+// LINKTYPE_USER0 and contain a complete Wayland message, header included.
+const pcapLinkTypeUser0 = 147
+
+// PcapWriter exports proxied traffic as pcapng for Wireshark. Each client
+// connection gets its own interface; events are flagged inbound (towards
+// the client) and requests outbound.
+type PcapWriter struct {
+	file       *os.File
+	w          *bufio.Writer
+	interfaces map[*Client]uint32
+	lock       sync.Mutex
+}
+
+func NewPcapWriter(path string) (*PcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	pw := &PcapWriter{
+		file:       f,
+		w:          bufio.NewWriter(f),
+		interfaces: make(map[*Client]uint32),
+	}
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, uint32(pcapngByteOrderMagic))
+	binary.Write(&body, binary.LittleEndian, uint16(1)) // major
+	binary.Write(&body, binary.LittleEndian, uint16(0)) // minor
+	binary.Write(&body, binary.LittleEndian, int64(-1)) // section length
+	writePcapOption(&body, pcapngOptShbUserAppl, []byte("wlhax"))
+	writePcapOption(&body, pcapngOptEnd, nil)
+	pw.writeBlock(pcapngSectionHeader, body.Bytes())
+
+	if err := pw.w.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return pw, nil
+}
+
+func writePcapOption(buf *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(buf, binary.LittleEndian, code)
+	binary.Write(buf, binary.LittleEndian, uint16(len(value)))
+	buf.Write(value)
+	buf.Write(make([]byte, szup(uint32(len(value)))-uint32(len(value))))
+}
+
+func (pw *PcapWriter) writeBlock(blockType uint32, body []byte) {
+	length := uint32(12 + len(body))
+	binary.Write(pw.w, binary.LittleEndian, blockType)
+	binary.Write(pw.w, binary.LittleEndian, length)
+	pw.w.Write(body)
+	binary.Write(pw.w, binary.LittleEndian, length)
+}
+
+// interfaceFor returns the interface id of a client connection, writing a
+// new interface description block the first time the client is seen.
+func (pw *PcapWriter) interfaceFor(client *Client) uint32 {
+	if id, ok := pw.interfaces[client]; ok {
+		return id
+	}
+	id := uint32(len(pw.interfaces))
+	pw.interfaces[client] = id
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, uint16(pcapLinkTypeUser0))
+	binary.Write(&body, binary.LittleEndian, uint16(0)) // reserved
+	binary.Write(&body, binary.LittleEndian, uint32(pcapngSnapLen))
+	writePcapOption(&body, pcapngOptIfName, []byte(fmt.Sprintf("client-%d", client.id)))
+	writePcapOption(&body, pcapngOptIfDescription, []byte(fmt.Sprintf("Wayland client, pid %d", client.pid)))
+	writePcapOption(&body, pcapngOptIfTsresol, []byte{pcapngTsresolNanosecond})
+	writePcapOption(&body, pcapngOptEnd, nil)
+	pw.writeBlock(pcapngInterfaceDesc, body.Bytes())
+	return id
+}
+
+func (pw *PcapWriter) WritePacket(client *Client, packet *WaylandPacket, event bool) error {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	if pw.file == nil {
+		return errors.New("pcap writer is closed")
+	}
+
+	var data bytes.Buffer
+	size := uint32(len(packet.Arguments) + 8)
+	binary.Write(&data, binary.LittleEndian, packet.ObjectId)
+	binary.Write(&data, binary.LittleEndian, size<<16|uint32(packet.Opcode))
+	data.Write(packet.Arguments)
+
+	ts := uint64(packet.Timestamp.UnixNano())
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, pw.interfaceFor(client))
+	binary.Write(&body, binary.LittleEndian, uint32(ts>>32))
+	binary.Write(&body, binary.LittleEndian, uint32(ts))
+	binary.Write(&body, binary.LittleEndian, uint32(data.Len()))
+	binary.Write(&body, binary.LittleEndian, uint32(data.Len()))
+	body.Write(data.Bytes())
+	body.Write(make([]byte, szup(uint32(data.Len()))-uint32(data.Len())))
+
+	flags := uint32(pcapngFlagOutbound)
+	if event {
+		flags = pcapngFlagInbound
+	}
+	var flagBytes [4]byte
+	binary.LittleEndian.PutUint32(flagBytes[:], flags)
+	writePcapOption(&body, pcapngOptEpbFlags, flagBytes[:])
+	comment := packet.String()
+	if n := len(packet.Fds); n > 0 {
+		comment += fmt.Sprintf(" [%d fd(s) passed]", n)
+	}
+	writePcapOption(&body, pcapngOptComment, []byte(comment))
+	writePcapOption(&body, pcapngOptEnd, nil)
+	pw.writeBlock(pcapngEnhancedPacket, body.Bytes())
+
+	return pw.w.Flush()
+}
+
+func (pw *PcapWriter) Close() error {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	if pw.file == nil {
+		return nil
+	}
+	pw.w.Flush()
+	err := pw.file.Close()
+	pw.file = nil
+	return err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"git.sr.ht/~rockorager/vaxis"
+	"github.com/dwapp/wlhax/ui"
+)
+
+// Minimum time between two conversions of a surface into a terminal image,
+// so that animations do not keep the terminal busy
+const previewInterval = 200 * time.Millisecond
+
+// PreviewView shows the contents of a surface as of its last commit of a
+// shm buffer, using the best graphics the terminal supports.
+type PreviewView struct {
+	client    *Client
+	surfaceId uint32
+
+	image vaxis.Image
+	// Commit shown by image, the time it was made and the cell size it
+	// was made for
+	commit        uint32
+	converted     time.Time
+	width, height int
+	err           error
+}
+
+func NewPreviewView(client *Client, surfaceId uint32) *PreviewView {
+	return &PreviewView{
+		client:    client,
+		surfaceId: surfaceId,
+	}
+}
+
+// surface returns the surface previewed, or nil once it is destroyed.
+func (view *PreviewView) surface() *WlSurface {
+	if obj, ok := view.client.ObjectMap[view.surfaceId]; ok {
+		if surface, ok := obj.Data.(*WlSurface); ok {
+			return surface
+		}
+	}
+	return nil
+}
+
+func (view *PreviewView) Draw(ctx *ui.Context) {
+	ctx.Fill(0, 0, ctx.Width(), ctx.Height(), ' ', vaxis.Style{})
+	client := view.client
+	client.lock.RLock()
+	surface := view.surface()
+	var header string
+	switch {
+	case surface == nil:
+		header = fmt.Sprintf("wl_surface@%d: destroyed", view.surfaceId)
+	case surface.Snapshot == nil:
+		header = fmt.Sprintf("%s: no shm buffer committed yet", surface.Object)
+	default:
+		snap := surface.Snapshot
+		header = fmt.Sprintf("%s: %dx%d %s, commit %d at %s", surface.Object,
+			snap.Width, snap.Height, shmFormatName(snap.Format), snap.Commit,
+			snap.Time.Format("15:04:05.000"))
+		if snap.Commit != view.commit && time.Since(view.converted) >= previewInterval {
+			view.convert(ctx.Window().Vx, snap)
+		}
+	}
+	client.lock.RUnlock()
+
+	ctx.Printf(0, 0, vaxis.Style{Foreground: vaxis.IndexColor(226)}, "%s", header)
+	if view.err != nil {
+		ctx.Printf(0, 1, vaxis.Style{Foreground: vaxis.RGBColor(255, 0, 0)}, "%s", view.err)
+		return
+	}
+	if view.image == nil || ctx.Height() < 2 {
+		return
+	}
+	width, height := ctx.Width(), ctx.Height()-1
+	if width != view.width || height != view.height {
+		view.image.Resize(width, height)
+		view.width, view.height = width, height
+	}
+	view.image.Draw(ctx.Subcontext(0, 1, width, height).Window())
+}
+
+// convert replaces the image with the contents of snap. The client lock
+// must be held.
+func (view *PreviewView) convert(vx *vaxis.Vaxis, snap *Snapshot) {
+	view.commit = snap.Commit
+	view.converted = time.Now()
+	if view.image != nil {
+		view.image.Destroy()
+		view.image = nil
+	}
+	img, err := snap.Image()
+	if view.err = err; err != nil {
+		return
+	}
+	view.image, err = vx.NewImage(img)
+	if err != nil {
+		// The terminal has no graphics at all
+		view.image = vx.NewHalfBlockImage(img)
+	}
+	view.width, view.height = 0, 0
+}
+
+func (view *PreviewView) Invalidate() {
+	ui.Invalidate()
+}
+
+func (view *PreviewView) Focus(focus bool) {
+	// This space deliberately left blank
+}
+
+func (view *PreviewView) Event(event vaxis.Event) bool {
+	return false
+}
+
+// Close frees the image.
+func (view *PreviewView) Close() {
+	if view.image != nil {
+		view.image.Destroy()
+		view.image = nil
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Most recent problems kept per client
+const maxProblems = 200
+
+// Problem is a protocol violation seen in the traffic of a client.
+type Problem struct {
+	Time time.Time
+	// Set when the compositor is at fault rather than the client
+	Compositor bool
+	// Object the problem is about, if any
+	Object  *WaylandObject
+	Message string
+}
+
+// Party names the side at fault.
+func (p *Problem) Party() string {
+	if p.Compositor {
+		return "compositor"
+	}
+	return "client"
+}
+
+func (p *Problem) String() string {
+	return fmt.Sprintf("%s %s: %s", p.Time.Format("15:04:05.000"), p.Party(), p.Message)
+}
+
+// zombie is an object destroyed by a destructor, until its id is reused.
+type zombie struct {
+	Interface string
+	// Destroyed by an event rather than a request
+	ByEvent bool
+}
+
+// problem records a protocol violation and notifies the proxy. The client
+// lock must be held.
+func (client *Client) problem(compositor bool, object *WaylandObject, format string, v ...interface{}) {
+	p := Problem{
+		Time:       client.packetTime,
+		Compositor: compositor,
+		Object:     object,
+		Message:    fmt.Sprintf(format, v...),
+	}
+	client.ProblemCount++
+	if len(client.Problems) >= maxProblems {
+		client.Problems = append(client.Problems[:0], client.Problems[1:]...)
+	}
+	client.Problems = append(client.Problems, p)
+	if client.proxy != nil {
+		client.proxy.notifyProblem(client, &p)
+	}
+}
+
+// messageName describes the message of a packet without its arguments.
+func messageName(object *WaylandObject, packet *WaylandPacket) string {
+	if packet.Message == nil {
+		return fmt.Sprintf("%s.opcode_%d", object, packet.Opcode)
+	}
+	return fmt.Sprintf("%s.%s", object, packet.Message.Name)
+}
+
+// checkUnknown flags a message for an object the compositor has deleted.
+// Other unknown ids are not flagged, as they may have been created by
+// messages of protocols without XML.
+func (client *Client) checkUnknown(packet *WaylandPacket, event bool) {
+	z, ok := client.zombies[packet.ObjectId]
+	if !ok || !event && z.ByEvent {
+		// The client may not have read the destructor event yet
+		return
+	}
+	kind := "request"
+	if event {
+		kind = "event"
+	}
+	client.problem(event, nil, "%s for %s@%d after the object was destroyed",
+		kind, z.Interface, packet.ObjectId)
+}
+
+// checkMessage flags messages the object model forbids, once packet is
+// decoded.
+func (client *Client) checkMessage(object *WaylandObject, packet *WaylandPacket, event bool) {
+	name := messageName(object, packet)
+	if z, ok := client.zombies[object.ObjectId]; ok {
+		switch {
+		case !event && !z.ByEvent:
+			client.problem(false, object, "%s after the object was destroyed", name)
+		case event && z.ByEvent:
+			client.problem(true, object, "%s after the object was destroyed", name)
+		}
+		// Messages crossing a destructor on the wire are legal
+	}
+	if packet.Message == nil {
+		if client.protocols.Interface(object.Interface) != nil {
+			client.problem(event, object, "%s does not exist", name)
+		}
+		return
+	}
+	if object.Version != 0 && packet.Message.Since > object.Version {
+		client.problem(event, object, "%s needs version %d, bound at version %d",
+			name, packet.Message.Since, object.Version)
+	}
+	if dep := packet.Message.DeprecatedSince; dep != 0 && object.Version >= dep {
+		client.problem(event, object, "%s is not used since version %d, bound at version %d",
+			name, dep, object.Version)
+	}
+	if len(packet.Args) == len(packet.Message.Args) {
+		for idx, arg := range packet.Args {
+			enum := packet.Message.Args[idx].Enum
+			switch value := arg.Value.(type) {
+			case uint32:
+				client.checkEnum(object, event, name, enum, value)
+			case int32:
+				client.checkEnum(object, event, name, enum, uint32(value))
+			}
+		}
+	}
+	if packet.Message.Destructor {
+		if client.zombies == nil {
+			client.zombies = make(map[uint32]zombie)
+		}
+		client.zombies[object.ObjectId] = zombie{
+			Interface: object.Interface,
+			ByEvent:   event,
+		}
+	}
+}
+
+// checkEnum flags a value of an enum of the object's interface that is
+// newer than the object.
+func (client *Client) checkEnum(object *WaylandObject, event bool, name, enum string, value uint32) {
+	if enum == "" || strings.Contains(enum, ".") || object.Version == 0 {
+		return
+	}
+	entry := client.protocols.EnumEntry(object.Interface, enum, value)
+	if entry != nil && entry.Since > object.Version {
+		client.problem(event, object, "%s: %s needs version %d, bound at version %d",
+			name, entry.Name, entry.Since, object.Version)
+	}
+}
+
+// deleted keeps track of an id the compositor has deleted with delete_id,
+// so later messages for it are flagged.
+func (client *Client) deleted(objectId uint32) {
+	if _, ok := client.zombies[objectId]; ok {
+		return
+	}
+	object, ok := client.ObjectMap[objectId]
+	if !ok {
+		return
+	}
+	if client.protocols.Interface(object.Interface) != nil {
+		client.problem(true, object, "delete_id for %s, which was not destroyed", object)
+	}
+	if client.zombies == nil {
+		client.zombies = make(map[uint32]zombie)
+	}
+	client.zombies[objectId] = zombie{Interface: object.Interface, ByEvent: true}
+}
+
+// setVersions gives the objects created by a message the version of the
+// object it was sent to, or the version requested in wl_registry.bind.
+func (client *Client) setVersions(object *WaylandObject, packet *WaylandPacket) {
+	for _, arg := range packet.Args {
+		if arg.Type != "new_id" {
+			continue
+		}
+		created, ok := client.ObjectMap[arg.Value.(uint32)]
+		if !ok || created.Version != 0 {
+			continue
+		}
+		created.Version = object.Version
+		if arg.Version != 0 {
+			created.Version = arg.Version
+		}
+	}
+}
+
+// ExtensionRoleState is a role given to a surface by a protocol wlhax does
+// not model, such as layer-shell, so it is not mistaken for a surface
+// without a role.
+type ExtensionRoleState struct {
+	Name string
+}
+
+func (s ExtensionRoleState) String() string {
+	return s.Name
+}
+
+func (s ExtensionRoleState) Details() []string {
+	return nil
+}
+
+// roleRequests are the requests of protocols without an Implementation that
+// give a role to the wl_surface passed as Arg. An empty Role is named after
+// the object the request creates.
+var roleRequests = map[string]struct{ Arg, Role string }{
+	"wl_data_device.start_drag":                   {"icon", "drag icon"},
+	"wl_shell.get_shell_surface":                  {"surface", ""},
+	"zxdg_shell_v6.get_xdg_surface":               {"surface", ""},
+	"zwlr_layer_shell_v1.get_layer_surface":       {"surface", ""},
+	"ext_session_lock_v1.get_lock_surface":        {"surface", ""},
+	"zwp_input_panel_v1.get_input_panel_surface":  {"surface", ""},
+	"zwp_input_method_v2.get_input_popup_surface": {"surface", ""},
+	"zwp_tablet_tool_v2.set_cursor":               {"surface", "tablet cursor"},
+}
+
+// assignRoles records the role a request of roleRequests gives to a surface.
+func (client *Client) assignRoles(packet *WaylandPacket) {
+	if packet.Message == nil {
+		return
+	}
+	request, ok := roleRequests[packet.Interface+"."+packet.Message.Name]
+	if !ok {
+		return
+	}
+	role := request.Role
+	var surface *WlSurface
+	for _, arg := range packet.Args {
+		if arg.Null || arg.Type != "new_id" && arg.Name != request.Arg {
+			continue
+		}
+		id, _ := arg.Value.(uint32)
+		obj, ok := client.ObjectMap[id]
+		if !ok {
+			continue
+		}
+		if arg.Type == "new_id" {
+			if role == "" {
+				role = obj.String()
+			}
+		} else {
+			surface, _ = obj.Data.(*WlSurface)
+		}
+	}
+	if surface != nil && role != "" && surface.Next.Role == nil {
+		surface.Next.Role = ExtensionRoleState{role}
+	}
+}
+
+// checkCommit flags a surface committing a buffer it may not have yet.
+func (client *Client) checkCommit(surface *WlSurface) {
+	state := &surface.Next
+	if state.Buffer == nil || state.BufferNum == surface.Current.BufferNum {
+		return
+	}
+	role := state.Role
+	if role == nil {
+		role = surface.Current.Role
+	}
+	switch role := role.(type) {
+	case nil:
+		if !surface.flaggedRoleless {
+			surface.flaggedRoleless = true
+			client.problem(false, surface.Object,
+				"buffer committed to %s, which has no role", surface.Object)
+		}
+	case XdgSurfaceState:
+		xdg := role.XdgSurface
+		if !xdg.Configured && !xdg.flaggedUnconfigured {
+			xdg.flaggedUnconfigured = true
+			client.problem(false, xdg.Object,
+				"buffer committed to %s before the initial configure was acked", xdg.Object)
+		}
+	}
+}
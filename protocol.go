@@ -6,16 +6,28 @@ import (
 	"errors"
 	"math"
 	"net"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
 type WaylandPacket struct {
+	Timestamp time.Time
 	ObjectId  uint32
 	Length    uint16
 	Opcode    uint16
 	Arguments []byte
 	Fds       []uintptr
+	// Details of Fds for packets loaded from a capture file
+	FdInfo []CaptureFd
+	// Contents of the shm buffer handed over by a wl_surface.commit, kept
+	// for the capture file
+	Content *CaptureBuffer
+
+	// Filled in from the protocol XML when the target interface is known
+	Interface string
+	Message   *ProtocolMessage
+	Args      []WaylandArgument
 
 	buffer *bytes.Buffer
 }
@@ -24,6 +36,8 @@ type WaylandGlobal struct {
 	Interface string
 	GlobalId  uint32
 	Version   uint32
+	// When global_remove arrived, zero while the global is advertised
+	Removed time.Time
 }
 
 type WaylandFixed int32
@@ -39,6 +53,10 @@ func (f WaylandFixed) ToDouble() float64 {
 	return d - (3 << 43)
 }
 
+func FixedFromDouble(d float64) WaylandFixed {
+	return WaylandFixed(math.Round(d * 256))
+}
+
 func ReadPacket(conn *net.UnixConn) (*WaylandPacket, error) {
 	var fds []uintptr
 	var buf [8]byte
@@ -72,10 +90,11 @@ func ReadPacket(conn *net.UnixConn) (*WaylandPacket, error) {
 	}
 
 	packet := &WaylandPacket{
-		ObjectId: binary.LittleEndian.Uint32(buf[0:4]),
-		Opcode:   binary.LittleEndian.Uint16(buf[4:6]),
-		Length:   binary.LittleEndian.Uint16(buf[6:8]),
-		Fds:      fds,
+		Timestamp: time.Now(),
+		ObjectId:  binary.LittleEndian.Uint32(buf[0:4]),
+		Opcode:    binary.LittleEndian.Uint16(buf[4:6]),
+		Length:    binary.LittleEndian.Uint16(buf[6:8]),
+		Fds:       fds,
 	}
 
 	packet.Arguments = make([]byte, packet.Length-8)
@@ -153,6 +172,9 @@ func (packet *WaylandPacket) ReadString() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if l == 0 {
+		return "", nil
+	}
 	var pl uint32 = szup(l)
 	buf := make([]byte, pl)
 	n, err := packet.buffer.Read(buf)
@@ -165,6 +187,23 @@ func (packet *WaylandPacket) ReadString() (string, error) {
 	return string(buf[:l-1]), nil
 }
 
+func (packet *WaylandPacket) ReadArray() ([]byte, error) {
+	var l uint32
+	err := binary.Read(packet.buffer, binary.LittleEndian, &l)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, szup(l))
+	n, err := packet.buffer.Read(buf)
+	if err != nil && l != 0 {
+		return nil, err
+	}
+	if n != len(buf) {
+		return nil, errors.New("ReadArray underread")
+	}
+	return buf[:l], nil
+}
+
 func (packet *WaylandPacket) Data() []byte {
 	return packet.buffer.Bytes()
 }
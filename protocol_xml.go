@@ -0,0 +1,292 @@
+package main
+
+import (
+	"embed"
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Signatures of the core protocol and xdg-shell, so that the most common
+// traffic decodes even without system protocol files.
+//
+//go:embed protocols/*.xml
+var builtinProtocols embed.FS
+
+// Locations searched for protocol XML files in addition to the built-in
+// protocol. Missing directories are silently skipped.
+var systemProtocolPaths = []string{
+	"/usr/share/wayland/wayland.xml",
+	"/usr/share/wayland-protocols",
+}
+
+type ProtocolArg struct {
+	Name      string
+	Type      string
+	Interface string
+	AllowNull bool
+	Enum      string
+}
+
+type ProtocolMessage struct {
+	Name   string
+	Opcode uint16
+	Since  uint32
+	// Version from which the message must no longer be used, 0 if none
+	DeprecatedSince uint32
+	Destructor      bool
+	Args            []ProtocolArg
+}
+
+type ProtocolEnumEntry struct {
+	Name  string
+	Value uint32
+	Since uint32
+}
+
+type ProtocolEnum struct {
+	Name     string
+	Bitfield bool
+	Entries  []ProtocolEnumEntry
+}
+
+type ProtocolInterface struct {
+	Name     string
+	Version  uint32
+	Requests []*ProtocolMessage
+	Events   []*ProtocolMessage
+	Enums    map[string]*ProtocolEnum
+}
+
+// ProtocolSet holds every interface definition wlhax knows about, keyed by
+// interface name. Definitions loaded later replace earlier ones, so a
+// user-supplied file can override the system copy of a protocol.
+type ProtocolSet struct {
+	Interfaces map[string]*ProtocolInterface
+}
+
+type xmlArg struct {
+	Name      string `xml:"name,attr"`
+	Type      string `xml:"type,attr"`
+	Interface string `xml:"interface,attr"`
+	AllowNull string `xml:"allow-null,attr"`
+	Enum      string `xml:"enum,attr"`
+}
+
+type xmlMessage struct {
+	Name            string   `xml:"name,attr"`
+	Type            string   `xml:"type,attr"`
+	Since           string   `xml:"since,attr"`
+	DeprecatedSince string   `xml:"deprecated-since,attr"`
+	Args            []xmlArg `xml:"arg"`
+}
+
+type xmlEntry struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+	Since string `xml:"since,attr"`
+}
+
+type xmlEnum struct {
+	Name     string     `xml:"name,attr"`
+	Bitfield string     `xml:"bitfield,attr"`
+	Entries  []xmlEntry `xml:"entry"`
+}
+
+type xmlInterface struct {
+	Name     string       `xml:"name,attr"`
+	Version  string       `xml:"version,attr"`
+	Requests []xmlMessage `xml:"request"`
+	Events   []xmlMessage `xml:"event"`
+	Enums    []xmlEnum    `xml:"enum"`
+}
+
+type xmlProtocol struct {
+	XMLName    xml.Name       `xml:"protocol"`
+	Name       string         `xml:"name,attr"`
+	Interfaces []xmlInterface `xml:"interface"`
+}
+
+func NewProtocolSet() *ProtocolSet {
+	return &ProtocolSet{
+		Interfaces: make(map[string]*ProtocolInterface),
+	}
+}
+
+// LoadProtocols builds a ProtocolSet from the built-in protocols, the system
+// protocol directories, and finally the given paths, which may be
+// either XML files or directories to search recursively.
+func LoadProtocols(paths []string) (*ProtocolSet, error) {
+	set := NewProtocolSet()
+	builtin, _ := builtinProtocols.ReadDir("protocols")
+	for _, entry := range builtin {
+		f, err := builtinProtocols.Open("protocols/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		err = set.Load(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "built-in "+entry.Name())
+		}
+	}
+	for _, path := range systemProtocolPaths {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		set.LoadPath(path)
+	}
+	for _, path := range paths {
+		if err := set.LoadPath(path); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// LoadPath loads a single protocol file, or every *.xml file found below a
+// directory.
+func (set *ProtocolSet) LoadPath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return set.LoadFile(path)
+	}
+	var first error
+	filepath.WalkDir(path, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".xml") {
+			return nil
+		}
+		if err := set.LoadFile(p); err != nil && first == nil {
+			first = err
+		}
+		return nil
+	})
+	return first
+}
+
+func (set *ProtocolSet) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return errors.Wrap(set.Load(f), path)
+}
+
+func (set *ProtocolSet) Load(r io.Reader) error {
+	var proto xmlProtocol
+	if err := xml.NewDecoder(r).Decode(&proto); err != nil {
+		return err
+	}
+	for _, xi := range proto.Interfaces {
+		iface := &ProtocolInterface{
+			Name:    xi.Name,
+			Version: parseProtocolUint(xi.Version, 1),
+			Enums:   make(map[string]*ProtocolEnum),
+		}
+		iface.Requests = convertMessages(xi.Requests)
+		iface.Events = convertMessages(xi.Events)
+		for _, xe := range xi.Enums {
+			enum := &ProtocolEnum{
+				Name:     xe.Name,
+				Bitfield: xe.Bitfield == "true",
+			}
+			for _, entry := range xe.Entries {
+				enum.Entries = append(enum.Entries, ProtocolEnumEntry{
+					Name:  entry.Name,
+					Value: parseProtocolUint(entry.Value, 0),
+					Since: parseProtocolUint(entry.Since, 1),
+				})
+			}
+			iface.Enums[xe.Name] = enum
+		}
+		set.Interfaces[iface.Name] = iface
+	}
+	return nil
+}
+
+func convertMessages(in []xmlMessage) []*ProtocolMessage {
+	out := make([]*ProtocolMessage, len(in))
+	for idx, xm := range in {
+		msg := &ProtocolMessage{
+			Name:            xm.Name,
+			Opcode:          uint16(idx),
+			Since:           parseProtocolUint(xm.Since, 1),
+			DeprecatedSince: parseProtocolUint(xm.DeprecatedSince, 0),
+			Destructor:      xm.Type == "destructor",
+		}
+		for _, xa := range xm.Args {
+			msg.Args = append(msg.Args, ProtocolArg{
+				Name:      xa.Name,
+				Type:      xa.Type,
+				Interface: xa.Interface,
+				AllowNull: xa.AllowNull == "true",
+				Enum:      xa.Enum,
+			})
+		}
+		out[idx] = msg
+	}
+	return out
+}
+
+func parseProtocolUint(s string, def uint32) uint32 {
+	if s == "" {
+		return def
+	}
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return def
+	}
+	return uint32(v)
+}
+
+func (set *ProtocolSet) Interface(name string) *ProtocolInterface {
+	if set == nil {
+		return nil
+	}
+	return set.Interfaces[name]
+}
+
+// Message returns the request (or event) with the given opcode on the named
+// interface, or nil if it is unknown.
+func (set *ProtocolSet) Message(iface string, opcode uint16, event bool) *ProtocolMessage {
+	i := set.Interface(iface)
+	if i == nil {
+		return nil
+	}
+	msgs := i.Requests
+	if event {
+		msgs = i.Events
+	}
+	if int(opcode) >= len(msgs) {
+		return nil
+	}
+	return msgs[opcode]
+}
+
+// EnumEntry returns the entry of an enum of iface with the given value, or
+// nil if it is unknown. The enum may be qualified with another interface,
+// as in "wl_output.transform".
+func (set *ProtocolSet) EnumEntry(iface, enum string, value uint32) *ProtocolEnumEntry {
+	if i, e, ok := strings.Cut(enum, "."); ok {
+		iface, enum = i, e
+	}
+	i := set.Interface(iface)
+	if i == nil || i.Enums[enum] == nil {
+		return nil
+	}
+	for idx := range i.Enums[enum].Entries {
+		if entry := &i.Enums[enum].Entries[idx]; entry.Value == value {
+			return entry
+		}
+	}
+	return nil
+}
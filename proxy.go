@@ -1,11 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kyoh86/xdg"
@@ -13,9 +15,11 @@ import (
 )
 
 var noopClientCallback = func(*Client) {}
+var noopObjectCallback = func(*Client, *WaylandObject) {}
+var noopPacketCallback = func(*Client, *WaylandPacket, bool) {}
+var noopFrameCallback = func(*Client, FrameSample) {}
+var noopProblemCallback = func(*Client, *Problem) {}
 
-// TODO: Support synthetic servers without forwarding events, so users can
-// manually send requests to clients
 type Proxy struct {
 	listener      net.Listener
 	proxyDisplay  string
@@ -24,11 +28,24 @@ type Proxy struct {
 	onUpdate      func(*Client)
 	onConnect     func(*Client)
 	onDisconnect  func(*Client)
-
-	Clients []*Client
-
-	SlowMode bool
-	Block    bool
+	onCreate      func(*Client, *WaylandObject)
+	onDestroy     func(*Client, *WaylandObject)
+	onPacket      func(*Client, *WaylandPacket, bool)
+	onFrame       func(*Client, FrameSample)
+	onProblem     func(*Client, *Problem)
+
+	Clients   []*Client
+	Protocols *ProtocolSet
+	Capture   *CaptureWriter
+	// Set by StartPcap from the UI while clients export to it
+	pcap atomic.Pointer[PcapWriter]
+	// Answers requests itself instead of forwarding them, if set
+	Synthetic *SyntheticServer
+	nextId    uint32 // atomic, clients are accepted concurrently
+
+	Debugger Debugger
+	Rules    RuleSet
+	Faults   FaultInjector
 }
 
 type Implementation interface {
@@ -45,23 +62,46 @@ type Client struct {
 	proxy  *Proxy
 	remote *net.UnixConn
 	pid    int32
+	name   string
+	id     uint32
 
 	Err       error
 	Timestamp time.Time
+	// Timestamp of the packet currently being recorded
+	packetTime time.Time
 
 	RxLog []*WaylandPacket
 	TxLog []*WaylandPacket
+	Rates ClientRates
 
 	Objects   []*WaylandObject
 	ObjectMap map[uint32]*WaylandObject
 	Globals   []*WaylandGlobal
 	GlobalMap map[uint32]*WaylandGlobal
 
+	BufferStats BufferStats
+	// Recent protocol violations, and how many there were in all
+	Problems     []Problem
+	ProblemCount int
+	// Destroyed objects whose ids have not been reused
+	zombies map[uint32]zombie
+	// Mapped wl_shm pools, for snapshots
+	shmMappings map[*ShmMapping]bool
+
 	lock sync.RWMutex
+	// Serialize writes to conn and remote
+	writeLock       sync.Mutex
+	remoteWriteLock sync.Mutex
+	ids             IdMap
+	debug           clientDebug
+	delays          eventDelays
+	// Names of globals dropped by rules
+	hiddenGlobals map[uint32]bool
 
 	closeOnce sync.Once
 
-	Impls map[string]Implementation
+	protocols *ProtocolSet
+	Impls     map[string]Implementation
 }
 
 func (c *Client) String() string {
@@ -72,10 +112,29 @@ func (c *Client) Pid() int32 {
 	return c.pid
 }
 
+// Name returns the executable name of the client, if known.
+func (c *Client) Name() string {
+	return c.name
+}
+
 type WaylandObject struct {
 	ObjectId  uint32
 	Interface string
-	Data      Destroyable
+	// Version the object was bound or created with, 0 if unknown
+	Version uint32
+	// Global the object was bound to, if any
+	Global *WaylandGlobal
+	Data   Destroyable
+
+	// Set for objects only known from the protocol XML, whose creation no
+	// Implementation has handled. These are not dispatched to Impls.
+	generic bool
+}
+
+// Inert reports whether the object was bound to a global that has since
+// been removed, so the compositor ignores its requests.
+func (wo *WaylandObject) Inert() bool {
+	return wo.Global != nil && !wo.Global.Removed.IsZero()
 }
 
 func (wo *WaylandObject) String() string {
@@ -85,6 +144,14 @@ func (wo *WaylandObject) String() string {
 	return fmt.Sprintf("%s@%d", wo.Interface, wo.ObjectId)
 }
 
+// DisplayPath resolves a WAYLAND_DISPLAY value to a socket path.
+func DisplayPath(display string) string {
+	if path.IsAbs(display) {
+		return display
+	}
+	return path.Join(xdg.RuntimeDir(), display)
+}
+
 func NewProxy(proxyDisplay, remoteDisplay string) (*Proxy, error) {
 	var proxyPath string
 	if !path.IsAbs(proxyDisplay) {
@@ -98,12 +165,7 @@ func NewProxy(proxyDisplay, remoteDisplay string) (*Proxy, error) {
 		return nil, err
 	}
 
-	var remotePath string
-	if !path.IsAbs(remoteDisplay) {
-		remotePath = path.Join(xdg.RuntimeDir(), remoteDisplay)
-	} else {
-		remotePath = remoteDisplay
-	}
+	remotePath := DisplayPath(remoteDisplay)
 
 	os.Setenv("WAYLAND_DISPLAY", proxyDisplay)
 
@@ -115,9 +177,36 @@ func NewProxy(proxyDisplay, remoteDisplay string) (*Proxy, error) {
 		onUpdate:      noopClientCallback,
 		onConnect:     noopClientCallback,
 		onDisconnect:  noopClientCallback,
+		onCreate:      noopObjectCallback,
+		onDestroy:     noopObjectCallback,
+		onPacket:      noopPacketCallback,
+		onFrame:       noopFrameCallback,
+		onProblem:     noopProblemCallback,
 	}, nil
 }
 
+// NewOfflineProxy creates a proxy without any sockets, whose clients are
+// loaded from a capture file for browsing.
+func NewOfflineProxy(capturePath string) *Proxy {
+	return &Proxy{
+		proxyDisplay: capturePath,
+		onUpdate:     noopClientCallback,
+		onConnect:    noopClientCallback,
+		onDisconnect: noopClientCallback,
+		onCreate:     noopObjectCallback,
+		onDestroy:    noopObjectCallback,
+		onPacket:     noopPacketCallback,
+		onFrame:      noopFrameCallback,
+		onProblem:    noopProblemCallback,
+	}
+}
+
+// Offline reports whether the proxy is browsing a capture file instead of
+// forwarding live traffic.
+func (proxy *Proxy) Offline() bool {
+	return proxy.listener == nil
+}
+
 func (proxy *Proxy) Run() {
 	for {
 		conn, err := proxy.listener.Accept()
@@ -140,11 +229,50 @@ func (proxy *Proxy) ProxyDisplay() string {
 }
 
 func (proxy *Proxy) RemoteDisplay() string {
+	if proxy.Synthetic != nil {
+		return "(synthetic)"
+	}
 	return proxy.remoteDisplay
 }
 
 func (proxy *Proxy) Close() {
-	proxy.listener.Close()
+	if proxy.listener != nil {
+		proxy.listener.Close()
+	}
+	if proxy.Capture != nil {
+		proxy.Capture.Close()
+	}
+	proxy.StopPcap()
+}
+
+// StartPcap begins exporting traffic of all clients to a pcapng file,
+// replacing any export already in progress.
+func (proxy *Proxy) StartPcap(path string) error {
+	pw, err := NewPcapWriter(path)
+	if err != nil {
+		return err
+	}
+	if old := proxy.pcap.Swap(pw); old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (proxy *Proxy) StopPcap() {
+	if pw := proxy.pcap.Swap(nil); pw != nil {
+		pw.Close()
+	}
+}
+
+// export writes a proxied packet to the capture and pcapng files, if any.
+// It must be called before the packet's fds are closed.
+func (proxy *Proxy) export(client *Client, packet *WaylandPacket, event bool) {
+	if proxy.Capture != nil {
+		proxy.Capture.WritePacket(client, packet, event)
+	}
+	if pw := proxy.pcap.Load(); pw != nil {
+		pw.WritePacket(client, packet, event)
+	}
 }
 
 func (proxy *Proxy) OnUpdate(onUpdate func(*Client)) {
@@ -168,6 +296,48 @@ func (proxy *Proxy) OnDisconnect(onDisconnect func(*Client)) {
 	proxy.onDisconnect = onDisconnect
 }
 
+func (proxy *Proxy) OnObjectCreate(onCreate func(*Client, *WaylandObject)) {
+	if onCreate == nil {
+		onCreate = noopObjectCallback
+	}
+	proxy.onCreate = onCreate
+}
+
+func (proxy *Proxy) OnObjectDestroy(onDestroy func(*Client, *WaylandObject)) {
+	if onDestroy == nil {
+		onDestroy = noopObjectCallback
+	}
+	proxy.onDestroy = onDestroy
+}
+
+// OnPacket is called with the client lock held for every packet once it has
+// been decoded, before it is applied to the client state. The last argument
+// is true for events.
+func (proxy *Proxy) OnPacket(onPacket func(*Client, *WaylandPacket, bool)) {
+	if onPacket == nil {
+		onPacket = noopPacketCallback
+	}
+	proxy.onPacket = onPacket
+}
+
+// OnFrame is called with the client lock held whenever a surface commits,
+// with its frame timing as of that commit.
+func (proxy *Proxy) OnFrame(onFrame func(*Client, FrameSample)) {
+	if onFrame == nil {
+		onFrame = noopFrameCallback
+	}
+	proxy.onFrame = onFrame
+}
+
+// OnProblem is called with the client lock held whenever a protocol
+// violation is seen.
+func (proxy *Proxy) OnProblem(onProblem func(*Client, *Problem)) {
+	if onProblem == nil {
+		onProblem = noopProblemCallback
+	}
+	proxy.onProblem = onProblem
+}
+
 func (proxy *Proxy) notifyUpdate(client *Client) {
 	proxy.onUpdate(client)
 }
@@ -180,14 +350,39 @@ func (proxy *Proxy) notifyDisconnect(client *Client) {
 	proxy.onDisconnect(client)
 }
 
-func (proxy *Proxy) handleClient(conn net.Conn) {
+func (proxy *Proxy) notifyCreate(client *Client, object *WaylandObject) {
+	proxy.onCreate(client, object)
+}
+
+func (proxy *Proxy) notifyDestroy(client *Client, object *WaylandObject) {
+	proxy.onDestroy(client, object)
+}
+
+func (proxy *Proxy) notifyFrame(client *Client, sample FrameSample) {
+	proxy.onFrame(client, sample)
+}
+
+func (proxy *Proxy) notifyProblem(client *Client, problem *Problem) {
+	proxy.onProblem(client, problem)
+}
+
+func (proxy *Proxy) notifyPacket(client *Client, packet *WaylandPacket, event bool) {
+	proxy.onPacket(client, packet, event)
+}
+
+// newClient creates the model for a client connection, with wl_display@1
+// and every Implementation registered. conn is nil for offline clients.
+func (proxy *Proxy) newClient(conn *net.UnixConn) *Client {
 	wl_display := &WaylandObject{
 		Interface: "wl_display",
 		ObjectId:  1,
+		Version:   1,
 	}
 
 	client := &Client{
-		conn: conn.(*net.UnixConn),
+		conn:  conn,
+		proxy: proxy,
+		id:    atomic.AddUint32(&proxy.nextId, 1) - 1,
 
 		Timestamp: time.Now(),
 
@@ -199,11 +394,17 @@ func (proxy *Proxy) handleClient(conn net.Conn) {
 		Globals:   nil,
 		GlobalMap: make(map[uint32]*WaylandGlobal),
 
-		Impls: make(map[string]Implementation),
+		protocols: proxy.Protocols,
+		Impls:     make(map[string]Implementation),
 	}
+	client.debug.init()
+	client.debug.stepping = proxy.Debugger.Blocked()
 
-	pid, _ := getPidOfConn(client.conn)
-	client.pid = pid
+	if conn != nil {
+		pid, _ := getPidOfConn(client.conn)
+		client.pid = pid
+		client.name = getProcessName(pid)
+	}
 
 	proxy.Clients = append(proxy.Clients, client)
 
@@ -221,6 +422,7 @@ func (proxy *Proxy) handleClient(conn net.Conn) {
 	RegisterWlCompositor(client)
 	RegisterWlSubCompositor(client)
 	RegisterWlSurface(client)
+	RegisterWlRegion(client)
 	RegisterWlSubSurface(client)
 	RegisterXdgWmBase(client)
 	RegisterXdgPositioner(client)
@@ -240,17 +442,32 @@ func (proxy *Proxy) handleClient(conn net.Conn) {
 	RegisterCursorShapeDevice(client)
 	RegisterZxdgDecorationManager(client)
 	RegisterZxdgToplevelDecoration(client)
+	RegisterZxdgOutputManager(client)
+	RegisterZxdgOutput(client)
+
+	return client
+}
+
+func (proxy *Proxy) handleClient(conn net.Conn) {
+	client := proxy.newClient(conn.(*net.UnixConn))
+	if proxy.Capture != nil {
+		proxy.Capture.WriteConnect(client)
+	}
+
+	if proxy.Synthetic != nil {
+		proxy.notifyConnect(client)
+		go proxy.runClient(client)
+		return
+	}
 
 	remote, err := net.Dial("unix", proxy.remotePath)
 	if err != nil {
-		client.proxy = proxy
 		proxy.notifyUpdate(client)
 		client.Close(err)
 		return
 	}
 
 	client.remote = remote.(*net.UnixConn)
-	client.proxy = proxy
 	proxy.notifyConnect(client)
 
 	// Remote loop
@@ -261,43 +478,197 @@ func (proxy *Proxy) handleClient(conn net.Conn) {
 				client.Close(err)
 				return
 			}
-			client.lock.Lock()
-			client.RecordRx(packet)
-			client.lock.Unlock()
-			client.proxy.notifyUpdate(client)
-			err = packet.WritePacket(client.conn)
-			if err != nil {
+			original := packet
+			if packet = client.checkpoint(packet, true); packet == nil {
+				for _, fd := range original.Fds {
+					unix.Close(int(fd))
+				}
+				continue
+			}
+			if err := client.forwardEvent(packet); err != nil {
 				client.Close(err)
 				return
 			}
 		}
 	}()
 
-	// Client loop
-	go func() {
-		for {
-			packet, err := ReadPacket(client.conn)
-			if err != nil {
-				client.Close(err)
-				return
+	go proxy.runClient(client)
+}
+
+// runClient reads the requests of a client and passes them on until the
+// connection closes.
+func (proxy *Proxy) runClient(client *Client) {
+	for {
+		packet, err := ReadPacket(client.conn)
+		if err != nil {
+			client.Close(err)
+			return
+		}
+		client.lock.Lock()
+		packet = client.translateRequest(packet)
+		client.lock.Unlock()
+		original := packet
+		if packet = client.checkpoint(packet, false); packet == nil {
+			for _, fd := range original.Fds {
+				unix.Close(int(fd))
 			}
-			client.lock.Lock()
-			client.RecordTx(packet)
-			client.lock.Unlock()
-			for proxy.Block {
-				time.Sleep(500 * time.Millisecond)
+			continue
+		}
+		kept, delay, err := client.injectFaults(packet, false)
+		if kept == nil {
+			for _, fd := range packet.Fds {
+				unix.Close(int(fd))
 			}
-			client.proxy.notifyUpdate(client)
-			err = packet.WritePacket(client.remote)
 			if err != nil {
 				client.Close(err)
 				return
 			}
-			for _, fd := range packet.Fds {
+			continue
+		}
+		if delay > 0 {
+			// Requests that follow wait too, as they change the state
+			// the delayed request applies
+			time.Sleep(delay)
+			kept.Timestamp = time.Now()
+		}
+		client.lock.Lock()
+		rewritten := client.applyRules(kept, false)
+		if rewritten != nil {
+			client.RecordTx(rewritten)
+		}
+		client.lock.Unlock()
+		if rewritten == nil {
+			for _, fd := range kept.Fds {
 				unix.Close(int(fd))
 			}
+			continue
+		}
+		packet = rewritten
+		proxy.export(client, packet, false)
+		client.proxy.notifyUpdate(client)
+		err = client.deliverRequest(packet)
+		for _, fd := range packet.Fds {
+			unix.Close(int(fd))
+		}
+		if err != nil {
+			client.Close(err)
+			return
+		}
+	}
+}
+
+// deliverRequest passes a recorded request on to the compositor, or to the
+// synthetic server.
+func (client *Client) deliverRequest(packet *WaylandPacket) error {
+	if server := client.proxy.Synthetic; server != nil {
+		return server.Request(client, packet)
+	}
+	client.remoteWriteLock.Lock()
+	defer client.remoteWriteLock.Unlock()
+	return packet.WritePacket(client.remote)
+}
+
+// forwardEvent records an event and writes it to the client, unless it
+// concerns an object only wlhax knows about, or a rule or fault drops it.
+// Events delayed by a fault are held back while the others go on. The fds
+// of the event are closed once it has been written or dropped.
+func (client *Client) forwardEvent(packet *WaylandPacket) error {
+	client.writeLock.Lock()
+	defer client.writeLock.Unlock()
+	kept, delay, err := client.injectFaults(packet, true)
+	if kept == nil {
+		for _, fd := range packet.Fds {
+			unix.Close(int(fd))
+		}
+		return err
+	}
+	if delay > 0 {
+		client.holdEvent(kept, delay)
+		return nil
+	}
+	return client.passEvent(kept)
+}
+
+// passEvent is forwardEvent once faults are applied. The write lock must be
+// held.
+func (client *Client) passEvent(packet *WaylandPacket) error {
+	client.lock.Lock()
+	rewritten := client.applyRules(packet, true)
+	if rewritten == nil {
+		client.lock.Unlock()
+		for _, fd := range packet.Fds {
+			unix.Close(int(fd))
+		}
+		return nil
+	}
+	packet = rewritten
+	out := client.translateEvent(packet)
+	client.RecordRx(packet)
+	client.lock.Unlock()
+	client.proxy.export(client, packet, true)
+	client.proxy.notifyUpdate(client)
+	var err error
+	if out != nil {
+		err = out.WritePacket(client.conn)
+	}
+	for _, fd := range packet.Fds {
+		unix.Close(int(fd))
+	}
+	return err
+}
+
+// WriteEvent sends an event that did not come from the compositor to the
+// client, recording it as if it had been forwarded, and closes its fds. It
+// must be called without the client lock held.
+func (client *Client) WriteEvent(packet *WaylandPacket) error {
+	if client.conn == nil || client.Err != nil {
+		for _, fd := range packet.Fds {
+			unix.Close(int(fd))
+		}
+		return errors.New("client is not connected")
+	}
+	err := client.forwardEvent(packet)
+	if err != nil {
+		client.Close(err)
+	}
+	return err
+}
+
+// WriteRequest sends a request that the client did not make to the
+// compositor, recording it as if it had been forwarded, and closes its fds.
+// Objects it creates must have been allocated with Inject. It must be called
+// without the client lock held.
+func (client *Client) WriteRequest(packet *WaylandPacket) error {
+	defer func() {
+		for _, fd := range packet.Fds {
+			unix.Close(int(fd))
 		}
 	}()
+	if client.conn == nil || client.Err != nil {
+		return errors.New("client is not connected")
+	}
+	client.lock.Lock()
+	client.RecordTx(packet)
+	client.lock.Unlock()
+	client.proxy.export(client, packet, false)
+	client.proxy.notifyUpdate(client)
+	err := client.deliverRequest(packet)
+	if err != nil {
+		client.Close(err)
+	}
+	return err
+}
+
+// SendEvent encodes an event by name with NewPacket and sends it with
+// WriteEvent.
+func (client *Client) SendEvent(objectId uint32, name string, args ...interface{}) error {
+	client.lock.RLock()
+	packet, err := client.NewPacket(objectId, name, true, args...)
+	client.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	return client.WriteEvent(packet)
 }
 
 func (client *Client) Close(err error) {
@@ -312,13 +683,27 @@ func (client *Client) Close(err error) {
 			client.remote.Close()
 		}
 		client.Timestamp = time.Now()
+		client.releaseDebug()
+		client.dropHeldEvents()
+		// Close may be called with the lock held
+		go client.unmapShm()
 		if client.proxy != nil {
+			if client.proxy.Synthetic != nil {
+				client.proxy.Synthetic.forget(client)
+			}
+			if client.proxy.Capture != nil {
+				client.proxy.Capture.WriteDisconnect(client)
+			}
 			client.proxy.notifyDisconnect(client)
 		}
 	})
 }
 
 func (client *Client) RemoveObject(objectId uint32) {
+	client.removeObject(objectId, true)
+}
+
+func (client *Client) removeObject(objectId uint32, notify bool) {
 	if o, ok := client.ObjectMap[objectId]; ok {
 		for idx := range client.Objects {
 			if client.Objects[idx] == o {
@@ -330,6 +715,9 @@ func (client *Client) RemoveObject(objectId uint32) {
 			o.Data.Destroy()
 		}
 		delete(client.ObjectMap, objectId)
+		if notify && client.proxy != nil {
+			client.proxy.notifyDestroy(client, o)
+		}
 	}
 }
 
@@ -338,38 +726,66 @@ func (client *Client) NewObject(objectId uint32, iface string) *WaylandObject {
 		Interface: iface,
 		ObjectId:  objectId,
 	}
-	client.RemoveObject(objectId)
+	// A semantic handler taking over an object the generic decoder just
+	// created is not a new object as far as observers are concerned.
+	old, ok := client.ObjectMap[objectId]
+	notify := !ok || !old.generic || old.Interface != iface
+	client.removeObject(objectId, notify)
+	delete(client.zombies, objectId)
 	client.ObjectMap[objectId] = object
 	client.Objects = append(client.Objects, object)
+	if notify && client.proxy != nil {
+		client.proxy.notifyCreate(client, object)
+	}
 	return object
 }
 
 func (client *Client) RecordRx(packet *WaylandPacket) {
 	client.RxLog = append(client.RxLog, packet)
-
-	// Fallback for objects with unknown interfaces
-	if object, ok := client.ObjectMap[packet.ObjectId]; !ok {
-		client.NewObject(packet.ObjectId, "(unknown)")
-	} else {
-		if impl, ok := client.Impls[object.Interface]; ok {
-			if err := impl.Event(packet); err != nil {
-				client.Close(err)
-			}
-		}
-	}
+	client.record(packet, true)
 }
 
 func (client *Client) RecordTx(packet *WaylandPacket) {
 	client.TxLog = append(client.TxLog, packet)
+	client.record(packet, false)
+}
 
-	// Fallback for objects with unknown interfaces
-	if object, ok := client.ObjectMap[packet.ObjectId]; !ok {
-		client.NewObject(packet.ObjectId, "(unknown)")
+func (client *Client) record(packet *WaylandPacket, event bool) {
+	client.packetTime = packet.Timestamp
+	object, ok := client.ObjectMap[packet.ObjectId]
+	if !ok {
+		client.checkUnknown(packet, event)
+		// Fallback for objects with unknown interfaces
+		object = client.NewObject(packet.ObjectId, "(unknown)")
+		packet.Interface = object.Interface
+		client.Rates.record(packet, event)
+		client.proxy.notifyPacket(client, packet, event)
+		return
+	}
+
+	client.decode(object, packet, event)
+	client.Rates.record(packet, event)
+	client.proxy.notifyPacket(client, packet, event)
+	client.checkMessage(object, packet, event)
+	client.createObjects(packet)
+	if !event {
+		client.assignRoles(packet)
+	}
+	defer client.setVersions(object, packet)
+	if object.generic {
+		return
+	}
+	impl, ok := client.Impls[object.Interface]
+	if !ok {
+		return
+	}
+	var err error
+	if event {
+		err = impl.Event(packet)
 	} else {
-		if impl, ok := client.Impls[object.Interface]; ok {
-			if err := impl.Request(packet); err != nil {
-				client.Close(err)
-			}
-		}
+		err = impl.Request(packet)
+	}
+	if err != nil {
+		client.Close(err)
 	}
 }
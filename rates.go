@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Seconds of history kept by a RateCounter
+const rateHistory = 120
+
+// RateCounter counts events in one-second buckets over the last
+// rateHistory seconds.
+type RateCounter struct {
+	lock    sync.Mutex
+	buckets [rateHistory]uint64
+	// Unix second of the newest bucket
+	last int64
+}
+
+// advance moves the newest bucket to second, clearing those skipped. The
+// lock must be held.
+func (r *RateCounter) advance(second int64) {
+	if second <= r.last {
+		return
+	}
+	if second-r.last >= rateHistory {
+		r.buckets = [rateHistory]uint64{}
+	} else {
+		for s := r.last + 1; s <= second; s++ {
+			r.buckets[s%rateHistory] = 0
+		}
+	}
+	r.last = second
+}
+
+func (r *RateCounter) Add(t time.Time, n uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	second := t.Unix()
+	r.advance(second)
+	if r.last-second >= rateHistory {
+		return
+	}
+	r.buckets[second%rateHistory] += n
+}
+
+// Series returns the counts of the n seconds up to end, oldest first.
+func (r *RateCounter) Series(end time.Time, n int) []uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if n > rateHistory {
+		n = rateHistory
+	}
+	second := end.Unix()
+	series := make([]uint64, n)
+	for idx := range series {
+		s := second - int64(n-1-idx)
+		if s <= r.last && r.last-s < rateHistory {
+			series[idx] = r.buckets[s%rateHistory]
+		}
+	}
+	return series
+}
+
+// ClientRates tracks the traffic of a client over time.
+type ClientRates struct {
+	RxMessages, TxMessages RateCounter
+	RxBytes, TxBytes       RateCounter
+	Commits                RateCounter
+}
+
+func (rates *ClientRates) record(packet *WaylandPacket, event bool) {
+	size := uint64(len(packet.Arguments) + 8)
+	if event {
+		rates.RxMessages.Add(packet.Timestamp, 1)
+		rates.RxBytes.Add(packet.Timestamp, size)
+		return
+	}
+	rates.TxMessages.Add(packet.Timestamp, 1)
+	rates.TxBytes.Add(packet.Timestamp, size)
+	if packet.Interface == "wl_surface" && packet.Message != nil && packet.Message.Name == "commit" {
+		rates.Commits.Add(packet.Timestamp, 1)
+	}
+}
+
+// rateEnd is the time graphs of a client end at: now while it is
+// connected, or when it disconnected.
+func (client *Client) rateEnd() time.Time {
+	if client.Err != nil || client.conn == nil {
+		return client.Timestamp
+	}
+	return time.Now()
+}
+
+var sparkRunes = []rune("▁▂▃▄▅▆▇█")
+
+// Sparkline draws a series as a line of block characters scaled to its
+// maximum. Empty seconds are drawn as spaces.
+func Sparkline(series []uint64) string {
+	var max uint64
+	for _, v := range series {
+		if v > max {
+			max = v
+		}
+	}
+	var line strings.Builder
+	for _, v := range series {
+		if v == 0 {
+			line.WriteRune(' ')
+			continue
+		}
+		idx := int((v*uint64(len(sparkRunes)) - 1) / max)
+		line.WriteRune(sparkRunes[idx])
+	}
+	return line.String()
+}
+
+// Graph draws a series as columns of block characters, height rows high,
+// returned top row first.
+func Graph(series []uint64, height int) []string {
+	var max uint64
+	for _, v := range series {
+		if v > max {
+			max = v
+		}
+	}
+	rows := make([]string, height)
+	steps := uint64(height * len(sparkRunes))
+	for row := range rows {
+		var line strings.Builder
+		// Eighths of a row below this one
+		base := uint64((height - 1 - row) * len(sparkRunes))
+		for _, v := range series {
+			var level uint64
+			if max > 0 && v > 0 {
+				level = (v*steps-1)/max + 1
+			}
+			switch {
+			case level <= base:
+				line.WriteRune(' ')
+			case level-base >= uint64(len(sparkRunes)):
+				line.WriteRune(sparkRunes[len(sparkRunes)-1])
+			default:
+				line.WriteRune(sparkRunes[level-base-1])
+			}
+		}
+		rows[row] = line.String()
+	}
+	return rows
+}
+
+// formatRate formats the last complete second of a per-second series.
+func formatRate(series []uint64, unit string) string {
+	if len(series) < 2 {
+		return ""
+	}
+	return formatRateValue(series[len(series)-2], unit)
+}
+
+// formatRateValue formats a count per second of unit.
+func formatRateValue(count uint64, unit string) string {
+	v := float64(count)
+	switch {
+	case unit == "":
+		return fmt.Sprintf("%.0f/s", v)
+	case unit != "B":
+		return fmt.Sprintf("%.0f %s/s", v, unit)
+	case v >= 1<<20:
+		return fmt.Sprintf("%.1f MiB/s", v/(1<<20))
+	case v >= 1<<10:
+		return fmt.Sprintf("%.1f KiB/s", v/(1<<10))
+	default:
+		return fmt.Sprintf("%.0f B/s", v)
+	}
+}
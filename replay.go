@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Object ids at or above this are allocated by the compositor
+const serverIdStart = 0xff000000
+
+// Replayer re-sends the requests of a recorded client on a fresh connection
+// to the compositor and compares the events it receives with the recorded
+// ones.
+//
+// Client-allocated ids are reused as they are, since the compositor sees the
+// same sequence of creations and deletions. Compositor-allocated ids and
+// serials are learned by pairing each live event with the recorded event on
+// the same object with the same opcode, and are rewritten in later requests.
+// Before each request, the replayer waits for the events that were recorded
+// ahead of it, so that for example ack_configure follows its configure.
+// The captured contents of shm buffers are written into the replayed pools
+// just before the commits that handed them over.
+type Replayer struct {
+	recorded *Client
+	live     *Client
+	conn     *net.UnixConn
+	report   func(string)
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	err      error
+	expected []*WaylandPacket
+	ids      map[uint32]uint32
+	serials  map[uint32]uint32
+	pools    map[uint32]int
+	buffers  map[uint32]replayBuffer
+
+	// How long to wait for a recorded event before reporting it missing
+	Timeout     time.Duration
+	Requests    int
+	Divergences int
+}
+
+// replayBuffer is where a wl_shm buffer lies in a replayed pool. fd is a
+// duplicate of the pool fd, since a pool may be destroyed before its buffers.
+type replayBuffer struct {
+	fd     int
+	offset int64
+}
+
+func NewReplayer(recorded *Client, remotePath string, report func(string)) (*Replayer, error) {
+	conn, err := net.Dial("unix", remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// The live connection is modelled without any Implementation; only the
+	// generic decoder is needed to describe and compare its traffic.
+	wl_display := &WaylandObject{
+		Interface: "wl_display",
+		ObjectId:  1,
+	}
+	live := &Client{
+		remote:    conn.(*net.UnixConn),
+		Timestamp: time.Now(),
+		Objects:   []*WaylandObject{wl_display},
+		ObjectMap: map[uint32]*WaylandObject{
+			1: wl_display,
+		},
+		GlobalMap: make(map[uint32]*WaylandGlobal),
+		protocols: recorded.protocols,
+		Impls:     make(map[string]Implementation),
+	}
+
+	recorded.lock.RLock()
+	expected := append([]*WaylandPacket(nil), recorded.RxLog...)
+	recorded.lock.RUnlock()
+
+	r := &Replayer{
+		recorded: recorded,
+		live:     live,
+		conn:     live.remote,
+		report:   report,
+		expected: expected,
+		ids:      make(map[uint32]uint32),
+		serials:  make(map[uint32]uint32),
+		pools:    make(map[uint32]int),
+		buffers:  make(map[uint32]replayBuffer),
+		Timeout:  time.Second,
+	}
+	r.cond = sync.NewCond(&r.lock)
+	return r, nil
+}
+
+func (r *Replayer) divergef(format string, v ...interface{}) {
+	r.Divergences++
+	r.report(fmt.Sprintf(format, v...))
+}
+
+// Run replays every recorded request and returns once the remaining
+// recorded events have arrived or timed out.
+func (r *Replayer) Run() error {
+	defer r.close()
+	go r.readEvents()
+
+	r.recorded.lock.RLock()
+	requests := append([]*WaylandPacket(nil), r.recorded.TxLog...)
+	r.recorded.lock.RUnlock()
+
+	for _, req := range requests {
+		if err := r.waitFor(req.Timestamp); err != nil {
+			return err
+		}
+		if err := r.send(req); err != nil {
+			return err
+		}
+		r.Requests++
+	}
+	return r.waitFor(time.Time{})
+}
+
+func (r *Replayer) close() {
+	r.conn.Close()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for id, fd := range r.pools {
+		unix.Close(fd)
+		delete(r.pools, id)
+	}
+	for id, b := range r.buffers {
+		unix.Close(b.fd)
+		delete(r.buffers, id)
+	}
+}
+
+// waitFor blocks until no recorded event from before t is outstanding, and
+// reports the ones that do not arrive within Timeout as missing. A zero t
+// waits for all of them.
+func (r *Replayer) waitFor(t time.Time) error {
+	due := func(ev *WaylandPacket) bool {
+		return t.IsZero() || ev.Timestamp.Before(t)
+	}
+	pending := func() bool {
+		for _, ev := range r.expected {
+			if due(ev) {
+				return true
+			}
+		}
+		return false
+	}
+
+	deadline := time.Now().Add(r.Timeout)
+	timer := time.AfterFunc(r.Timeout, func() {
+		r.lock.Lock()
+		r.cond.Broadcast()
+		r.lock.Unlock()
+	})
+	defer timer.Stop()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for pending() && r.err == nil && time.Now().Before(deadline) {
+		r.cond.Wait()
+	}
+
+	var rest []*WaylandPacket
+	for _, ev := range r.expected {
+		if due(ev) {
+			r.divergef("missing event %s", ev)
+		} else {
+			rest = append(rest, ev)
+		}
+	}
+	r.expected = rest
+	if r.err == io.EOF && t.IsZero() {
+		return nil
+	}
+	return r.err
+}
+
+func (r *Replayer) readEvents() {
+	for {
+		packet, err := ReadPacket(r.conn)
+		r.lock.Lock()
+		if err != nil {
+			r.err = err
+			r.cond.Broadcast()
+			r.lock.Unlock()
+			return
+		}
+		r.track(packet, true)
+		r.match(packet)
+		r.cond.Broadcast()
+		r.lock.Unlock()
+		for _, fd := range packet.Fds {
+			unix.Close(int(fd))
+		}
+	}
+}
+
+// track decodes a packet of the live connection and keeps its object map up
+// to date.
+func (r *Replayer) track(packet *WaylandPacket, event bool) {
+	object, ok := r.live.ObjectMap[packet.ObjectId]
+	if !ok {
+		object = r.live.NewObject(packet.ObjectId, "(unknown)")
+	}
+	r.live.decode(object, packet, event)
+	r.live.createObjects(packet)
+}
+
+func (r *Replayer) mapId(id uint32) uint32 {
+	if id >= serverIdStart {
+		if live, ok := r.ids[id]; ok {
+			return live
+		}
+	}
+	return id
+}
+
+// match pairs a live event with the first outstanding recorded event on the
+// same object with the same opcode.
+func (r *Replayer) match(packet *WaylandPacket) {
+	for idx, ev := range r.expected {
+		if r.mapId(ev.ObjectId) != packet.ObjectId || ev.Opcode != packet.Opcode {
+			continue
+		}
+		r.expected = append(r.expected[:idx], r.expected[idx+1:]...)
+		r.compare(ev, packet)
+		return
+	}
+	r.divergef("unexpected event %s", packet)
+}
+
+func (r *Replayer) compare(recorded, live *WaylandPacket) {
+	if recorded.Message == nil || live.Message == nil || len(recorded.Args) != len(live.Args) {
+		if !bytes.Equal(recorded.Arguments, live.Arguments) {
+			r.divergef("event %s: got %s", recorded, live)
+		}
+		return
+	}
+
+	for idx, a := range recorded.Args {
+		b := live.Args[idx]
+		var same bool
+		switch {
+		case a.Type == "new_id":
+			r.ids[a.Value.(uint32)] = b.Value.(uint32)
+			same = true
+		case a.Type == "uint" && a.Name == "serial":
+			r.serials[a.Value.(uint32)] = b.Value.(uint32)
+			same = true
+		case a.Name == "time" || a.Type == "fd":
+			same = true
+		case a.Type == "object":
+			same = r.mapId(a.Value.(uint32)) == b.Value.(uint32)
+		case a.Type == "array":
+			same = bytes.Equal(a.Value.([]byte), b.Value.([]byte))
+		default:
+			same = a.String() == b.String()
+		}
+		if !same {
+			r.divergef("%s@%d.%s: %s: recorded %s, got %s", live.Interface,
+				live.ObjectId, live.Message.Name, a.Name, a, b)
+		}
+	}
+}
+
+func (r *Replayer) send(req *WaylandPacket) error {
+	r.lock.Lock()
+	packet, err := r.rewrite(req)
+	if err == nil {
+		r.track(packet, false)
+	}
+	r.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = packet.WritePacket(r.conn)
+	for _, fd := range packet.Fds {
+		unix.Close(int(fd))
+	}
+	return err
+}
+
+// rewrite builds the live version of a recorded request, with ids and
+// serials translated and fresh file descriptors.
+func (r *Replayer) rewrite(req *WaylandPacket) (*WaylandPacket, error) {
+	out := &WaylandPacket{
+		Timestamp: time.Now(),
+		ObjectId:  r.mapId(req.ObjectId),
+		Opcode:    req.Opcode,
+	}
+
+	if req.Message == nil {
+		out.Arguments = req.Arguments
+		for idx := range req.Fds {
+			fd, err := r.regenerateFd(req, idx, 0)
+			if err != nil {
+				return nil, err
+			}
+			out.Fds = append(out.Fds, uintptr(fd))
+		}
+		out.Length = uint16(len(out.Arguments) + 8)
+		return out, nil
+	}
+
+	args := append([]WaylandArgument(nil), req.Args...)
+	fdIndex := 0
+	for idx := range args {
+		arg := &args[idx]
+		switch {
+		case arg.Type == "object":
+			arg.Value = r.mapId(arg.Value.(uint32))
+		case arg.Type == "uint" && arg.Name == "serial":
+			if live, ok := r.serials[arg.Value.(uint32)]; ok {
+				arg.Value = live
+			}
+		case arg.Type == "fd":
+			var size int64
+			if req.Interface == "wl_shm" && req.Message.Name == "create_pool" {
+				size = int64(args[2].Value.(int32))
+			}
+			fd, err := r.regenerateFd(req, fdIndex, size)
+			if err != nil {
+				return nil, err
+			}
+			fdIndex++
+			out.Fds = append(out.Fds, uintptr(fd))
+		}
+	}
+
+	var err error
+	out.Arguments, err = EncodeArguments(args)
+	if err != nil {
+		return nil, err
+	}
+	out.Length = uint16(len(out.Arguments) + 8)
+
+	// Keep shm pools around so that resize can grow them like the
+	// original client did, and buffers so that commits can fill them in.
+	switch req.Interface + "." + req.Message.Name {
+	case "wl_shm.create_pool":
+		if fd, err := unix.Dup(int(out.Fds[0])); err == nil {
+			r.pools[args[0].Value.(uint32)] = fd
+		}
+	case "wl_shm_pool.resize":
+		if fd, ok := r.pools[out.ObjectId]; ok {
+			unix.Ftruncate(fd, int64(args[0].Value.(int32)))
+		}
+	case "wl_shm_pool.destroy":
+		if fd, ok := r.pools[out.ObjectId]; ok {
+			unix.Close(fd)
+			delete(r.pools, out.ObjectId)
+		}
+	case "wl_shm_pool.create_buffer":
+		if pool, ok := r.pools[out.ObjectId]; ok {
+			if fd, err := unix.Dup(pool); err == nil {
+				r.buffers[args[0].Value.(uint32)] = replayBuffer{fd, int64(args[1].Value.(int32))}
+			}
+		}
+	case "wl_buffer.destroy":
+		if b, ok := r.buffers[out.ObjectId]; ok {
+			unix.Close(b.fd)
+			delete(r.buffers, out.ObjectId)
+		}
+	case "wl_surface.commit":
+		if req.Content != nil {
+			if b, ok := r.buffers[req.Content.Buffer]; ok {
+				unix.Pwrite(b.fd, req.Content.Content, b.offset)
+			} else {
+				r.report(fmt.Sprintf("note: no replayed pool for buffer %d of %s, contents not restored",
+					req.Content.Buffer, req))
+			}
+		}
+	}
+	return out, nil
+}
+
+// regenerateFd creates a replacement for the idx-th fd of a recorded
+// request: a pipe for pipes, and otherwise a memfd holding the captured
+// content, or zeroes if the content was not captured. shm pools are filled
+// in later, from the buffers of each commit.
+func (r *Replayer) regenerateFd(req *WaylandPacket, idx int, size int64) (int, error) {
+	var info CaptureFd
+	if idx < len(req.FdInfo) {
+		info = req.FdInfo[idx]
+	}
+
+	if info.Mode&unix.S_IFMT == unix.S_IFIFO {
+		var p [2]int
+		if err := unix.Pipe2(p[:], unix.O_CLOEXEC); err != nil {
+			return -1, err
+		}
+		go func() {
+			f := os.NewFile(uintptr(p[0]), "replay-pipe")
+			io.Copy(io.Discard, f)
+			f.Close()
+		}()
+		return p[1], nil
+	}
+
+	if info.Size > size {
+		size = info.Size
+	}
+	fd, err := unix.MemfdCreate("wlhax-replay", unix.MFD_CLOEXEC)
+	if err != nil {
+		return -1, err
+	}
+	if err := unix.Ftruncate(fd, size); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	if len(info.Content) > 0 {
+		unix.Pwrite(fd, info.Content, 0)
+	} else if size > 0 && req.Interface != "wl_shm" {
+		r.report(fmt.Sprintf("note: no captured content for fd %d of %s, sending %d zero bytes",
+			idx, req, size))
+	}
+	return fd, nil
+}
+
+// runReplay implements "wlhax replay <capture> [client id]". It returns the
+// process exit status: 0 if the replay matched the recording, 1 if it
+// diverged and 2 on errors.
+func runReplay(args []string, protocols *ProtocolSet) int {
+	proxy := NewOfflineProxy(args[0])
+	proxy.Protocols = protocols
+	if err := proxy.LoadCapture(args[0]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var client *Client
+	for _, c := range proxy.Clients {
+		if len(args) < 2 || strconv.Itoa(int(c.id)) == args[1] {
+			client = c
+			break
+		}
+	}
+	if client == nil {
+		fmt.Fprintln(os.Stderr, "no such client in capture")
+		return 2
+	}
+
+	remoteDisplay, ok := os.LookupEnv("WAYLAND_DISPLAY")
+	if !ok {
+		fmt.Fprintln(os.Stderr, "No WAYLAND_DISPLAY set")
+		return 2
+	}
+	r, err := NewReplayer(client, DisplayPath(remoteDisplay), func(s string) {
+		fmt.Println(s)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	err = r.Run()
+	fmt.Printf("replayed %d of %d requests of client %d (pid %d), %d divergences\n",
+		r.Requests, len(client.TxLog), client.id, client.pid, r.Divergences)
+	if err != nil && !errors.Is(err, io.EOF) {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if r.Divergences > 0 {
+		return 1
+	}
+	return 0
+}
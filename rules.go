@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RuleAssignment replaces the value of an argument, written as it would be
+// in ParseMessage.
+type RuleAssignment struct {
+	Name  string
+	Value string
+}
+
+// Rule rewrites or drops the messages matching its pattern before they are
+// recorded and passed on.
+type Rule struct {
+	Id int
+	// Pid or executable name of the clients the rule applies to, empty
+	// for all of them
+	Client string
+	MessagePattern
+	// "drop" or "set"
+	Action   string
+	Assign   []RuleAssignment
+	Disabled bool
+}
+
+// ParseRule parses a rule of the form
+//
+//	[for <pid|executable>] drop <pattern>
+//	[for <pid|executable>] set <pattern> => arg=value...
+//
+// where the pattern is as in ParseMessagePattern. Set rules must name the
+// interface and message they rewrite, and their values are checked against
+// the protocol XML.
+func ParseRule(text string, protocols *ProtocolSet) (*Rule, error) {
+	rule := &Rule{}
+	text = strings.TrimSpace(text)
+	if rest, ok := strings.CutPrefix(text, "for "); ok {
+		rest = strings.TrimSpace(rest)
+		rule.Client, text, _ = strings.Cut(rest, " ")
+	}
+	action, rest, _ := strings.Cut(strings.TrimSpace(text), " ")
+	rule.Action = action
+
+	var assign string
+	switch action {
+	case "drop":
+	case "set":
+		var ok bool
+		rest, assign, ok = strings.Cut(rest, "=>")
+		if !ok {
+			return nil, errors.New("usage: set <pattern> => arg=value...")
+		}
+	default:
+		return nil, fmt.Errorf("unknown rule action %q, expected drop or set", action)
+	}
+
+	var err error
+	rule.MessagePattern, err = ParseMessagePattern(strings.Fields(rest))
+	if err != nil {
+		return nil, err
+	}
+	if action == "drop" {
+		return rule, nil
+	}
+	if rule.Interface == "" || rule.Message == "" {
+		return nil, errors.New("set rules must name an interface and message")
+	}
+	words, err := splitMessageText(assign)
+	if err != nil {
+		return nil, err
+	}
+	for _, word := range words {
+		name, value, ok := strings.Cut(word, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid assignment %s", word)
+		}
+		rule.Assign = append(rule.Assign, RuleAssignment{name, value})
+	}
+	if len(rule.Assign) == 0 {
+		return nil, errors.New("set rules need at least one arg=value")
+	}
+	if err := rule.check(protocols); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// check parses the values of a set rule for every message it may rewrite,
+// so that a rule that cannot apply is refused rather than skipped.
+func (rule *Rule) check(protocols *ProtocolSet) error {
+	iface := protocols.Interface(rule.Interface)
+	if iface == nil {
+		return fmt.Errorf("unknown interface %s", rule.Interface)
+	}
+	var msgs []*ProtocolMessage
+	if rule.Direction != "event" {
+		msgs = append(msgs, iface.Requests...)
+	}
+	if rule.Direction != "request" {
+		msgs = append(msgs, iface.Events...)
+	}
+	found := false
+	for _, msg := range msgs {
+		if msg.Name != rule.Message {
+			continue
+		}
+		found = true
+		for _, a := range rule.Assign {
+			if _, _, err := protocols.assignment(rule.Interface, msg, a); err != nil {
+				return fmt.Errorf("%s.%s: %v", rule.Interface, msg.Name, err)
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s has no message %s", rule.Interface, rule.Message)
+	}
+	return nil
+}
+
+func (rule *Rule) String() string {
+	text := fmt.Sprintf("%d: ", rule.Id)
+	if rule.Client != "" {
+		text += "for " + rule.Client + " "
+	}
+	text += fmt.Sprintf("%s %s", rule.Action, rule.MessagePattern)
+	if len(rule.Assign) > 0 {
+		var assign []string
+		for _, a := range rule.Assign {
+			assign = append(assign, a.Name+"="+a.Value)
+		}
+		text += " => " + strings.Join(assign, " ")
+	}
+	if rule.Disabled {
+		text += " (disabled)"
+	}
+	return text
+}
+
+// RuleSet holds the rules of a proxy, applied in order. The zero value has
+// none.
+type RuleSet struct {
+	lock   sync.Mutex
+	rules  []*Rule
+	nextId int
+}
+
+func (rs *RuleSet) Add(rule *Rule) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.nextId++
+	rule.Id = rs.nextId
+	rs.rules = append(rs.rules, rule)
+}
+
+// Delete removes a rule by id, or all of them if id is 0.
+func (rs *RuleSet) Delete(id int) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if id == 0 {
+		rs.rules = nil
+		return nil
+	}
+	for idx, rule := range rs.rules {
+		if rule.Id == id {
+			rs.rules = append(rs.rules[:idx], rs.rules[idx+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no rule %d", id)
+}
+
+// SetEnabled enables or disables a rule by id, or all of them if id is 0.
+func (rs *RuleSet) SetEnabled(id int, enabled bool) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	found := false
+	for _, rule := range rs.rules {
+		if rule.Id == id || id == 0 {
+			rule.Disabled = !enabled
+			found = true
+		}
+	}
+	if !found && id != 0 {
+		return fmt.Errorf("no rule %d", id)
+	}
+	return nil
+}
+
+func (rs *RuleSet) Rules() []*Rule {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return append([]*Rule(nil), rs.rules...)
+}
+
+// Load adds the rules of a file, one per line. Blank lines and lines
+// starting with # are ignored. Nothing is added if any line is invalid.
+func (rs *RuleSet) Load(path string, protocols *ProtocolSet) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var rules []*Rule
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		rule, err := ParseRule(text, protocols)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		rs.Add(rule)
+	}
+	return nil
+}
+
+// clientMatches reports whether a client has the pid or executable name
+// given by scope. An empty scope matches every client.
+func clientMatches(scope string, client *Client) bool {
+	return scope == "" || scope == client.Name() ||
+		scope == strconv.Itoa(int(client.Pid()))
+}
+
+func (rs *RuleSet) active() []*Rule {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	var rules []*Rule
+	for _, rule := range rs.rules {
+		if !rule.Disabled {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// applyRules runs a message through the rules of the proxy before it is
+// recorded, so the model sees what the other side gets. It returns the
+// rewritten packet, or nil if the message is dropped. Globals hidden from
+// the client stay hidden: their wl_registry.global_remove is dropped too.
+// The client lock must be held.
+func (client *Client) applyRules(packet *WaylandPacket, event bool) *WaylandPacket {
+	rules := client.proxy.Rules.active()
+	if len(rules) == 0 && len(client.hiddenGlobals) == 0 {
+		return packet
+	}
+	object, ok := client.ObjectMap[packet.ObjectId]
+	if !ok {
+		return packet
+	}
+	client.decode(object, packet, event)
+	if packet.Message == nil {
+		return packet
+	}
+
+	global := event && packet.Interface == "wl_registry"
+	if global && packet.Message.Name == "global_remove" {
+		name := packet.Args[0].Value.(uint32)
+		if client.hiddenGlobals[name] {
+			delete(client.hiddenGlobals, name)
+			return nil
+		}
+	}
+
+	for _, rule := range rules {
+		if !clientMatches(rule.Client, client) || !rule.Match(packet, event) {
+			continue
+		}
+		if rule.Action == "drop" {
+			if global && packet.Message.Name == "global" {
+				if client.hiddenGlobals == nil {
+					client.hiddenGlobals = make(map[uint32]bool)
+				}
+				client.hiddenGlobals[packet.Args[0].Value.(uint32)] = true
+			}
+			return nil
+		}
+		// Assignments were checked when the rule was added
+		if out, err := client.rewrite(packet, rule.Assign); err == nil {
+			client.decode(object, out, event)
+			packet = out
+		}
+	}
+	return packet
+}
+
+// rewrite returns a copy of a decoded packet with some arguments replaced.
+func (client *Client) rewrite(packet *WaylandPacket, assign []RuleAssignment) (*WaylandPacket, error) {
+	args := append([]WaylandArgument(nil), packet.Args...)
+	for _, a := range assign {
+		idx, arg, err := client.protocols.assignment(packet.Interface, packet.Message, a)
+		if err != nil {
+			return nil, err
+		}
+		args[idx] = arg
+	}
+	payload, err := EncodeArguments(args)
+	if err != nil {
+		return nil, err
+	}
+	out := *packet
+	out.Arguments = payload
+	out.Length = uint16(len(payload) + 8)
+	out.Reset()
+	return &out, nil
+}
+
+// assignment parses the value a rule gives to an argument of a message,
+// and returns the index of the argument with its new value.
+func (set *ProtocolSet) assignment(iface string, msg *ProtocolMessage, a RuleAssignment) (int, WaylandArgument, error) {
+	idx := -1
+	for i, spec := range msg.Args {
+		if spec.Name == a.Name {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return -1, WaylandArgument{}, fmt.Errorf("%s has no argument %s", msg.Name, a.Name)
+	}
+	spec := msg.Args[idx]
+	if spec.Type == "fd" || spec.Type == "new_id" {
+		return -1, WaylandArgument{}, fmt.Errorf("%s: cannot rewrite %s arguments", spec.Name, spec.Type)
+	}
+	v, err := set.parseArgument(iface, spec, a.Value)
+	if err != nil {
+		return -1, WaylandArgument{}, err
+	}
+	arg, err := argumentValue(spec, v)
+	if err != nil {
+		return -1, WaylandArgument{}, err
+	}
+	return idx, arg, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// wl_shm formats with a preview. Other than the first two, they are
+// DRM fourcc codes.
+const (
+	shmFormatArgb8888 uint32 = 0
+	shmFormatXrgb8888 uint32 = 1
+	shmFormatAbgr8888 uint32 = 0x34324241
+	shmFormatXbgr8888 uint32 = 0x34324258
+)
+
+// ShmMapping is the memory of a wl_shm_pool, mapped read-only from a
+// duplicate of the client's fd. It stays mapped as long as the pool or any
+// of its buffers is alive, or until the client disconnects.
+type ShmMapping struct {
+	client *Client
+	fd     int
+	data   []byte
+	refs   int
+}
+
+// mapShm maps the pool fd passed with wl_shm.create_pool. Pools loaded from
+// a capture file have no fd and cannot be mapped.
+func (client *Client) mapShm(packet *WaylandPacket, size int32) (*ShmMapping, error) {
+	if len(packet.Fds) == 0 || packet.Fds[0] == ^uintptr(0) {
+		return nil, errors.New("no pool fd")
+	}
+	// Not inherited by clients started with :exec
+	fd, err := unix.FcntlInt(packet.Fds[0], unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	m := &ShmMapping{client: client, fd: fd, refs: 1}
+	if err := m.resize(size); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if client.shmMappings == nil {
+		client.shmMappings = make(map[*ShmMapping]bool)
+	}
+	client.shmMappings[m] = true
+	return m, nil
+}
+
+func (m *ShmMapping) resize(size int32) error {
+	if m.data != nil {
+		unix.Munmap(m.data)
+		m.data = nil
+	}
+	if size <= 0 {
+		return fmt.Errorf("invalid pool size %d", size)
+	}
+	data, err := unix.Mmap(m.fd, 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
+
+func (m *ShmMapping) ref() *ShmMapping {
+	if m != nil {
+		m.refs++
+	}
+	return m
+}
+
+func (m *ShmMapping) unref() {
+	if m == nil {
+		return
+	}
+	if m.refs--; m.refs == 0 {
+		m.release()
+	}
+}
+
+func (m *ShmMapping) release() {
+	if m.data != nil {
+		unix.Munmap(m.data)
+		m.data = nil
+	}
+	if m.fd >= 0 {
+		unix.Close(m.fd)
+		m.fd = -1
+	}
+	delete(m.client.shmMappings, m)
+}
+
+// unmapShm releases the pools of a client once it has disconnected.
+func (client *Client) unmapShm() {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	for m := range client.shmMappings {
+		m.release()
+	}
+}
+
+// Snapshot is a copy of the pixels of a shm buffer, taken when a surface
+// committed it.
+type Snapshot struct {
+	Width, Height, Stride int32
+	Format                uint32
+	Pixels                []byte
+	Time                  time.Time
+	// Commit of the surface the snapshot was taken at
+	Commit uint32
+	// Memory of the previous copy, reused by the next one
+	spare []byte
+}
+
+// snapshot copies the contents of the buffer into snap, reusing the pixel
+// memory of an earlier copy. snap is left as it was if the copy fails.
+func (b *WlShmBuffer) snapshot(snap *Snapshot) error {
+	pixels, err := b.contents(snap.spare)
+	if err != nil {
+		return err
+	}
+	snap.spare, snap.Pixels = snap.Pixels, pixels
+	snap.Width, snap.Height, snap.Stride = b.Width, b.Height, b.Stride
+	snap.Format = b.Format
+	return nil
+}
+
+// contents copies the memory of the buffer into buf, which is grown if it
+// is too small, and returns the copy.
+func (b *WlShmBuffer) contents(buf []byte) (_ []byte, err error) {
+	m := b.mapping
+	if m == nil || m.data == nil {
+		return nil, errors.New("pool is not mapped")
+	}
+	if b.Width <= 0 || b.Height <= 0 || b.Stride <= 0 || b.Offset < 0 {
+		return nil, errors.New("invalid buffer geometry")
+	}
+	size := int(b.Stride) * int(b.Height)
+	if int(b.Offset)+size > len(m.data) {
+		return nil, errors.New("buffer lies outside its pool")
+	}
+	// The client may truncate the file under the mapping, which would
+	// otherwise kill wlhax with SIGBUS.
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if recover() != nil {
+			err = errors.New("pool memory is no longer accessible")
+		}
+	}()
+	if cap(buf) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	copy(buf, m.data[b.Offset:int(b.Offset)+size])
+	return buf, nil
+}
+
+// Image converts the snapshot into an image, for the formats in common
+// use.
+func (snap *Snapshot) Image() (image.Image, error) {
+	// Offsets of red, green, blue and alpha in a little endian pixel
+	var r, g, b, a int
+	switch snap.Format {
+	case shmFormatArgb8888, shmFormatXrgb8888:
+		r, g, b, a = 2, 1, 0, 3
+	case shmFormatAbgr8888, shmFormatXbgr8888:
+		r, g, b, a = 0, 1, 2, 3
+	default:
+		return nil, fmt.Errorf("no preview for format %s", shmFormatName(snap.Format))
+	}
+	if snap.Stride < snap.Width*4 {
+		return nil, errors.New("stride is too small for the format")
+	}
+	if len(snap.Pixels) < int(snap.Stride)*int(snap.Height) {
+		return nil, errors.New("snapshot is smaller than its geometry")
+	}
+	opaque := snap.Format == shmFormatXrgb8888 || snap.Format == shmFormatXbgr8888
+	img := image.NewRGBA(image.Rect(0, 0, int(snap.Width), int(snap.Height)))
+	for y := 0; y < int(snap.Height); y++ {
+		src := snap.Pixels[y*int(snap.Stride):]
+		dst := img.Pix[y*img.Stride:]
+		for x := 0; x < int(snap.Width); x++ {
+			p := src[x*4 : x*4+4]
+			// Wayland alpha is premultiplied, like image.RGBA
+			dst[x*4], dst[x*4+1], dst[x*4+2] = p[r], p[g], p[b]
+			if opaque {
+				dst[x*4+3] = 0xff
+			} else {
+				dst[x*4+3] = p[a]
+			}
+		}
+	}
+	return img, nil
+}
+
+// WritePNG saves the snapshot to a PNG file.
+func (snap *Snapshot) WritePNG(path string) error {
+	img, err := snap.Image()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func shmFormatName(format uint32) string {
+	switch format {
+	case shmFormatArgb8888:
+		return "argb8888"
+	case shmFormatXrgb8888:
+		return "xrgb8888"
+	}
+	// Other formats are fourcc codes
+	fourcc := []byte{byte(format), byte(format >> 8), byte(format >> 16), byte(format >> 24)}
+	for _, c := range fourcc {
+		if c < ' ' || c > '~' {
+			return fmt.Sprintf("0x%08x", format)
+		}
+	}
+	return string(fourcc)
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 )
 
@@ -19,3 +23,16 @@ func getPidOfConn(conn *net.UnixConn) (int32, error) {
 
 	return cred.Pid, nil
 }
+
+// getProcessName returns the executable name of a process, or an empty
+// string if it cannot be found.
+func getProcessName(pid int32) string {
+	if exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid)); err == nil {
+		return filepath.Base(exe)
+	}
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
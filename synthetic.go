@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Globals advertised by the synthetic server unless -globals is given
+const defaultSyntheticGlobals = "wl_compositor:6,wl_subcompositor:1,wl_shm:1," +
+	"wl_seat:7,wl_output:4,xdg_wm_base:6,zxdg_output_manager_v1:3"
+
+// SyntheticServer plays a minimal compositor for clients of a proxy without
+// an upstream display. It advertises its globals, answers wl_display.sync,
+// configures xdg surfaces on their first commit, completes frame callbacks
+// at the refresh rate of its output and releases buffers as soon as they are
+// committed. Nothing is displayed.
+//
+// Replies are queued while the server state is locked and sent once it is
+// unlocked, since a failed write closes the client, which forgets its state.
+type SyntheticServer struct {
+	Globals []*WaylandGlobal
+
+	// Size sent in toplevel configures, 0 to let the client decide
+	Width, Height int32
+
+	lock    sync.Mutex
+	serial  uint32
+	clients map[*Client]*syntheticClient
+}
+
+type syntheticXdgSurface struct {
+	id         uint32
+	configured bool
+	// xdg_toplevel or xdg_popup, and the id of the role object
+	role   string
+	roleId uint32
+	// Popup size, from the positioner
+	width, height int32
+}
+
+// Interval between frame callbacks, matching the 60 Hz mode of the
+// synthetic output
+const syntheticFrameInterval = time.Second / 60
+
+type syntheticEvent struct {
+	id   uint32
+	name string
+	args []interface{}
+}
+
+type syntheticClient struct {
+	buffers     map[uint32]uint32
+	frames      map[uint32][]uint32
+	xdgSurfaces map[uint32]*syntheticXdgSurface
+	positioners map[uint32][2]int32
+	// Frame callbacks of committed surfaces, fired on the next frame
+	due    []uint32
+	pacing bool
+	events []syntheticEvent
+}
+
+// send queues an event until the server state is unlocked.
+func (c *syntheticClient) send(id uint32, name string, args ...interface{}) {
+	c.events = append(c.events, syntheticEvent{id, name, args})
+}
+
+// flush sends the queued events of a client. The server lock must be held,
+// and is released.
+func (s *SyntheticServer) flush(client *Client, c *syntheticClient) error {
+	events := c.events
+	c.events = nil
+	s.lock.Unlock()
+	for _, ev := range events {
+		if err := client.SendEvent(ev.id, ev.name, ev.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewSyntheticServer creates a server advertising the given globals, as
+// interface:version pairs separated by commas.
+func NewSyntheticServer(globals string) (*SyntheticServer, error) {
+	s := &SyntheticServer{
+		clients: make(map[*Client]*syntheticClient),
+	}
+	for _, spec := range strings.Split(globals, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		iface, ver, _ := strings.Cut(spec, ":")
+		version := uint64(1)
+		if ver != "" {
+			var err error
+			version, err = strconv.ParseUint(ver, 10, 32)
+			if err != nil || version == 0 {
+				return nil, fmt.Errorf("invalid version for global %s", iface)
+			}
+		}
+		s.Globals = append(s.Globals, &WaylandGlobal{
+			Interface: iface,
+			GlobalId:  uint32(len(s.Globals) + 1),
+			Version:   uint32(version),
+		})
+	}
+	return s, nil
+}
+
+func (s *SyntheticServer) nextSerial() uint32 {
+	s.serial++
+	return s.serial
+}
+
+func (s *SyntheticServer) state(client *Client) *syntheticClient {
+	c, ok := s.clients[client]
+	if !ok {
+		c = &syntheticClient{
+			buffers:     make(map[uint32]uint32),
+			frames:      make(map[uint32][]uint32),
+			xdgSurfaces: make(map[uint32]*syntheticXdgSurface),
+			positioners: make(map[uint32][2]int32),
+		}
+		s.clients[client] = c
+	}
+	return c
+}
+
+func (s *SyntheticServer) forget(client *Client) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.clients, client)
+}
+
+// Request answers a request the client has sent. The packet must already
+// have been recorded.
+func (s *SyntheticServer) Request(client *Client, packet *WaylandPacket) error {
+	if packet.Message == nil {
+		return nil
+	}
+	s.lock.Lock()
+	c := s.state(client)
+	args := packet.Args
+	switch packet.Interface + "." + packet.Message.Name {
+	case "wl_display.sync":
+		s.done(c, args[0].Value.(uint32), s.nextSerial())
+	case "wl_display.get_registry":
+		registry := args[0].Value.(uint32)
+		for _, global := range s.Globals {
+			c.send(registry, "global", global.GlobalId, global.Interface, global.Version)
+		}
+	case "wl_registry.bind":
+		id := args[1].Value.(uint32)
+		s.bound(c, id, args[1].Interface, args[1].Version)
+	case "wl_surface.attach":
+		c.buffers[packet.ObjectId] = args[0].Value.(uint32)
+	case "wl_surface.frame":
+		c.frames[packet.ObjectId] = append(c.frames[packet.ObjectId], args[0].Value.(uint32))
+	case "wl_surface.commit":
+		s.commit(client, c, packet.ObjectId)
+	case "xdg_wm_base.get_xdg_surface":
+		c.xdgSurfaces[args[1].Value.(uint32)] = &syntheticXdgSurface{
+			id: args[0].Value.(uint32),
+		}
+	case "xdg_surface.get_toplevel":
+		if xs := c.xdgSurface(packet.ObjectId); xs != nil {
+			xs.role, xs.roleId = "xdg_toplevel", args[0].Value.(uint32)
+		}
+	case "xdg_surface.get_popup":
+		if xs := c.xdgSurface(packet.ObjectId); xs != nil {
+			size := c.positioners[args[2].Value.(uint32)]
+			xs.role, xs.roleId = "xdg_popup", args[0].Value.(uint32)
+			xs.width, xs.height = size[0], size[1]
+		}
+	case "zxdg_output_manager_v1.get_xdg_output":
+		s.xdgOutput(client, c, args[0].Value.(uint32), args[1].Value.(uint32))
+	case "xdg_positioner.set_size":
+		c.positioners[packet.ObjectId] = [2]int32{args[0].Value.(int32), args[1].Value.(int32)}
+	case "xdg_popup.reposition":
+		size := c.positioners[args[0].Value.(uint32)]
+		for _, xs := range c.xdgSurfaces {
+			if xs.roleId == packet.ObjectId {
+				xs.width, xs.height = size[0], size[1]
+				c.send(packet.ObjectId, "repositioned", args[1].Value)
+				s.configure(c, xs)
+			}
+		}
+	}
+
+	if packet.Message.Destructor {
+		c.destroy(packet.ObjectId)
+		c.send(1, "delete_id", packet.ObjectId)
+	}
+	return s.flush(client, c)
+}
+
+// destroy forgets everything about an object the client destroyed.
+func (c *syntheticClient) destroy(id uint32) {
+	delete(c.buffers, id)
+	delete(c.frames, id)
+	delete(c.xdgSurfaces, id)
+	delete(c.positioners, id)
+	for surface, xs := range c.xdgSurfaces {
+		if xs.id == id {
+			delete(c.xdgSurfaces, surface)
+		} else if xs.roleId == id {
+			xs.role, xs.roleId, xs.configured = "", 0, false
+		}
+	}
+}
+
+func (c *syntheticClient) xdgSurface(id uint32) *syntheticXdgSurface {
+	for _, xs := range c.xdgSurfaces {
+		if xs.id == id {
+			return xs
+		}
+	}
+	return nil
+}
+
+// done fires a wl_callback, which is destroyed by the server afterwards.
+func (s *SyntheticServer) done(c *syntheticClient, callback uint32, data uint32) {
+	c.send(callback, "done", data)
+	c.send(1, "delete_id", callback)
+}
+
+// bound sends the initial events of a freshly bound global.
+func (s *SyntheticServer) bound(c *syntheticClient, id uint32, iface string, version uint32) {
+	type event struct {
+		since uint32
+		name  string
+		args  []interface{}
+	}
+	var events []event
+	switch iface {
+	case "wl_shm":
+		events = []event{
+			{1, "format", []interface{}{0}}, // argb8888
+			{1, "format", []interface{}{1}}, // xrgb8888
+		}
+	case "wl_seat":
+		events = []event{
+			{1, "capabilities", []interface{}{0}},
+			{2, "name", []interface{}{"wlhax"}},
+		}
+	case "wl_output":
+		events = []event{
+			{1, "geometry", []interface{}{0, 0, 0, 0, 0, "wlhax", "synthetic", 0}},
+			{1, "mode", []interface{}{3, 1920, 1080, 60000}}, // current | preferred
+			{2, "scale", []interface{}{1}},
+			{4, "name", []interface{}{"WLHAX-1"}},
+			{4, "description", []interface{}{"wlhax synthetic output"}},
+			{2, "done", nil},
+		}
+	}
+	for _, ev := range events {
+		if version < ev.since {
+			continue
+		}
+		c.send(id, ev.name, ev.args...)
+	}
+}
+
+// xdgOutput describes the synthetic output to a new xdg_output. Its logical
+// size is its mode, at scale 1.
+func (s *SyntheticServer) xdgOutput(client *Client, c *syntheticClient, id, output uint32) {
+	client.lock.RLock()
+	version := uint32(1)
+	if obj, ok := client.ObjectMap[id]; ok && obj.Version != 0 {
+		version = obj.Version
+	}
+	client.lock.RUnlock()
+
+	c.send(id, "logical_position", 0, 0)
+	c.send(id, "logical_size", 1920, 1080)
+	if version >= 2 {
+		c.send(id, "name", "WLHAX-1")
+		c.send(id, "description", "wlhax synthetic output")
+	}
+	if version >= 3 {
+		c.send(output, "done")
+	} else {
+		c.send(id, "done")
+	}
+}
+
+func (s *SyntheticServer) commit(client *Client, c *syntheticClient, surface uint32) {
+	// Buffers of synchronized subsurfaces are only taken, then released,
+	// once their parent commits
+	client.lock.RLock()
+	applied := appliedSurfaces(client.ObjectMap[surface])
+	client.lock.RUnlock()
+	for _, id := range applied {
+		if buffer := c.buffers[id]; buffer != 0 {
+			delete(c.buffers, id)
+			c.send(buffer, "release")
+		}
+	}
+
+	c.due = append(c.due, c.frames[surface]...)
+	delete(c.frames, surface)
+	if len(c.due) > 0 && !c.pacing {
+		c.pacing = true
+		go s.pace(client, c)
+	}
+
+	if xs, ok := c.xdgSurfaces[surface]; ok && xs.role != "" && !xs.configured {
+		s.configure(c, xs)
+	}
+}
+
+// pace fires the frame callbacks of a client on every frame of the
+// synthetic output, until none are left or the client is gone.
+func (s *SyntheticServer) pace(client *Client, c *syntheticClient) {
+	ticker := time.NewTicker(syntheticFrameInterval)
+	defer ticker.Stop()
+	for t := range ticker.C {
+		s.lock.Lock()
+		if s.clients[client] != c || len(c.due) == 0 {
+			c.pacing = false
+			s.lock.Unlock()
+			return
+		}
+		now := uint32(t.UnixMilli())
+		for _, callback := range c.due {
+			s.done(c, callback, now)
+		}
+		c.due = nil
+		if s.flush(client, c) != nil {
+			return
+		}
+	}
+}
+
+// appliedSurfaces returns the surface just committed and its descendants,
+// unless their state is still cached.
+func appliedSurfaces(obj *WaylandObject) []uint32 {
+	if obj == nil {
+		return nil
+	}
+	surface, ok := obj.Data.(*WlSurface)
+	if !ok || surface.Cached != nil {
+		return nil
+	}
+	ids := []uint32{obj.ObjectId}
+	for _, child := range surface.Current.Children {
+		ids = append(ids, appliedSurfaces(child.Surface.Object)...)
+	}
+	return ids
+}
+
+// configure sends a configure sequence for the role of an xdg surface.
+func (s *SyntheticServer) configure(c *syntheticClient, xs *syntheticXdgSurface, states ...EnumXdgState) {
+	switch xs.role {
+	case "xdg_toplevel":
+		if len(states) == 0 {
+			states = []EnumXdgState{EnumXdgStateActivated}
+		}
+		array := make([]byte, 4*len(states))
+		for idx, state := range states {
+			binary.LittleEndian.PutUint32(array[4*idx:], uint32(state))
+		}
+		c.send(xs.roleId, "configure", s.Width, s.Height, array)
+	case "xdg_popup":
+		c.send(xs.roleId, "configure", 0, 0, xs.width, xs.height)
+	}
+	xs.configured = true
+	c.send(xs.id, "configure", s.nextSerial())
+}
+
+// Configure sends a new toplevel configure with the given size and states
+// to every toplevel of a client.
+func (s *SyntheticServer) Configure(client *Client, width, height int32, states []string) error {
+	var parsed []EnumXdgState
+	for _, name := range states {
+		state := EnumXdgStateMaximized
+		for ; state <= EnumXdgStateSuspended; state++ {
+			if state.String() == name {
+				break
+			}
+		}
+		if state > EnumXdgStateSuspended {
+			return fmt.Errorf("unknown toplevel state %s", name)
+		}
+		parsed = append(parsed, state)
+	}
+
+	s.lock.Lock()
+	s.Width, s.Height = width, height
+	c := s.state(client)
+	for _, xs := range c.xdgSurfaces {
+		if xs.role == "xdg_toplevel" && xs.configured {
+			s.configure(c, xs, parsed...)
+		}
+	}
+	return s.flush(client, c)
+}
+
+// CloseToplevels asks every toplevel of a client to close.
+func (s *SyntheticServer) CloseToplevels(client *Client) error {
+	s.lock.Lock()
+	c := s.state(client)
+	for _, xs := range c.xdgSurfaces {
+		if xs.role == "xdg_toplevel" {
+			c.send(xs.roleId, "close")
+		}
+	}
+	return s.flush(client, c)
+}
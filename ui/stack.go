@@ -28,6 +28,15 @@ func (stack *Stack) Pop() Drawable {
 	return d
 }
 
+func (stack *Stack) Remove(d Drawable) {
+	for i, child := range stack.children {
+		if child == d {
+			stack.children = append(stack.children[:i], stack.children[i+1:]...)
+			return
+		}
+	}
+}
+
 func (stack *Stack) Peek() Drawable {
 	if len(stack.children) == 0 {
 		return nil
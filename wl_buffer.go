@@ -2,10 +2,14 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
 type WlBufferType interface {
 	String() string
+	// Size in buffer pixels
+	Size() (int32, int32)
 }
 
 type BufferSubscriber interface {
@@ -20,6 +24,20 @@ type WlBuffer struct {
 	BufferType WlBufferType
 	Attached   bool
 	Committed  bool
+
+	// Lifecycle, oldest first
+	History []BufferEvent
+	// Set from commit to release
+	Held        bool
+	CommittedAt time.Time
+	// Set when a newer buffer is committed while this one is held
+	ReplacedAt         time.Time
+	Commits, Releases  uint32
+	AttachedWhileHeld  uint32
+	DestroyedWhileHeld bool
+
+	client   *Client
+	holdTime durationWindow
 }
 
 func (*WlBuffer) DashboardShouldDisplay() bool {
@@ -38,10 +56,33 @@ func (b *WlBuffer) DashboardPrint(printer func(string, ...interface{})) error {
 	} else {
 		printer("%s - %s %s", Indent(0), b.Object, b.BufferType.String())
 	}
+	if len(b.History) > 0 {
+		printer("%s%s", Indent(3), b.Lifecycle())
+	}
+	if b.Commits > 0 {
+		summary := fmt.Sprintf("commits: %d, releases: %d", b.Commits, b.Releases)
+		if len(b.holdTime.samples) > 0 {
+			summary += ", held " + formatMillis(b.holdTime.mean()) + " on average"
+		}
+		printer("%s%s", Indent(3), summary)
+	}
+	if b.client != nil {
+		for _, warning := range b.Warnings(b.client.rateEnd()) {
+			printer("%swarning: %s", Indent(3), warning)
+		}
+	}
 	return nil
 }
 
 func (r *WlBuffer) Destroy() error {
+	if r.client != nil {
+		r.client.BufferStats.count(-1, r.client.packetTime)
+		r.client.BufferStats.Destroyed++
+	}
+	if shm, ok := r.BufferType.(*WlShmBuffer); ok {
+		shm.mapping.unref()
+		shm.mapping = nil
+	}
 	if r.Subscriber != nil {
 		r.Subscriber.Destroy()
 		r.Attached = false
@@ -68,6 +109,11 @@ func RegisterWlBuffer(client *Client) {
 func (r *WlBufferImpl) Request(packet *WaylandPacket) error {
 	switch packet.Opcode {
 	case 0: // destroy
+		obj, ok := r.client.ObjectMap[packet.ObjectId]
+		if !ok {
+			return errors.New("no such buffer")
+		}
+		obj.Data.(*WlBuffer).destroyed(r.client.packetTime)
 	}
 	return nil
 }
@@ -80,6 +126,7 @@ func (r *WlBufferImpl) Event(packet *WaylandPacket) error {
 			return errors.New("no such buffer")
 		}
 		data := obj.Data.(*WlBuffer)
+		data.release(r.client.packetTime)
 		if data.Subscriber != nil {
 			data.Subscriber.Release()
 			data.Attached = false
@@ -2,10 +2,11 @@ package main
 
 import (
 	"errors"
+	"time"
 )
 
 type CallbackSubscriber interface {
-	Done() error
+	Done(callback *WaylandObject, t time.Time) error
 }
 
 type WlCallback struct {
@@ -46,7 +47,7 @@ func (r *WlCallbackImpl) Event(packet *WaylandPacket) error {
 		}
 		data := obj.Data.(*WlCallback)
 		if data.Subscriber != nil {
-			data.Subscriber.Done()
+			data.Subscriber.Done(obj, r.client.packetTime)
 		}
 	}
 	return nil
@@ -27,7 +27,10 @@ func (r *WlCompositorImpl) Request(packet *WaylandPacket) error {
 		if err != nil {
 			return err
 		}
-		r.client.NewObject(oid, "wl_region")
+		obj := r.client.NewObject(oid, "wl_region")
+		obj.Data = &WlRegion{
+			Object: obj,
+		}
 	}
 	return nil
 }
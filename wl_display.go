@@ -42,6 +42,7 @@ func (r *WlDisplayImpl) Event(packet *WaylandPacket) error {
 		if err != nil {
 			return err
 		}
+		r.client.deleted(oid)
 		r.client.RemoveObject(oid)
 	}
 	return nil
@@ -2,12 +2,187 @@ package main
 
 import (
 	"fmt"
+	"strings"
+	"time"
 )
 
+// EnumWlOutputMode represents the mode flags of wl_output.mode.
+type EnumWlOutputMode uint32
+
+const (
+	EnumWlOutputModeCurrent   EnumWlOutputMode = 0x1
+	EnumWlOutputModePreferred EnumWlOutputMode = 0x2
+)
+
+func (m EnumWlOutputMode) String() string {
+	var flags []string
+	if m&EnumWlOutputModeCurrent != 0 {
+		flags = append(flags, "current")
+	}
+	if m&EnumWlOutputModePreferred != 0 {
+		flags = append(flags, "preferred")
+	}
+	return strings.Join(flags, ", ")
+}
+
+// EnumWlOutputSubpixel represents the subpixel layout of wl_output.geometry.
+type EnumWlOutputSubpixel int32
+
+func (e EnumWlOutputSubpixel) String() string {
+	switch e {
+	case 0:
+		return "unknown"
+	case 1:
+		return "none"
+	case 2:
+		return "horizontal-rgb"
+	case 3:
+		return "horizontal-bgr"
+	case 4:
+		return "vertical-rgb"
+	case 5:
+		return "vertical-bgr"
+	default:
+		return fmt.Sprintf("invalid (%d)", int32(e))
+	}
+}
+
+// EnumWlOutputTransform represents the transform of wl_output.geometry.
+type EnumWlOutputTransform int32
+
+func (e EnumWlOutputTransform) String() string {
+	switch e {
+	case 0:
+		return "normal"
+	case 1:
+		return "90"
+	case 2:
+		return "180"
+	case 3:
+		return "270"
+	case 4:
+		return "flipped"
+	case 5:
+		return "flipped-90"
+	case 6:
+		return "flipped-180"
+	case 7:
+		return "flipped-270"
+	default:
+		return fmt.Sprintf("invalid (%d)", int32(e))
+	}
+}
+
+// WlOutputMode is a mode advertised with wl_output.mode, refresh in mHz.
+type WlOutputMode struct {
+	Flags         EnumWlOutputMode
+	Width, Height int32
+	Refresh       int32
+}
+
+func (m WlOutputMode) String() string {
+	s := fmt.Sprintf("%dx%d", m.Width, m.Height)
+	if m.Refresh != 0 {
+		s += fmt.Sprintf("@%.3fHz", float64(m.Refresh)/1000)
+	}
+	if m.Flags != 0 {
+		s += fmt.Sprintf(" (%s)", m.Flags)
+	}
+	return s
+}
+
+// WlOutputState is what the compositor has told a client about an output.
+type WlOutputState struct {
+	// Position in the global compositor space, physical size in mm
+	X, Y                          int32
+	PhysicalWidth, PhysicalHeight int32
+	Subpixel                      EnumWlOutputSubpixel
+	Make, Model                   string
+	Transform                     EnumWlOutputTransform
+	Modes                         []WlOutputMode
+	Scale                         int32
+	Name, Description             string
+}
+
+// CurrentMode returns the mode flagged current, or nil if there is none.
+func (state *WlOutputState) CurrentMode() *WlOutputMode {
+	for idx := range state.Modes {
+		if state.Modes[idx].Flags&EnumWlOutputModeCurrent != 0 {
+			return &state.Modes[idx]
+		}
+	}
+	return nil
+}
+
+// addMode records a mode event. A new current mode replaces the previous
+// one as current.
+func (state *WlOutputState) addMode(mode WlOutputMode) {
+	if mode.Flags&EnumWlOutputModeCurrent != 0 {
+		for idx := range state.Modes {
+			state.Modes[idx].Flags &^= EnumWlOutputModeCurrent
+		}
+	}
+	for idx, m := range state.Modes {
+		if m.Width == mode.Width && m.Height == mode.Height && m.Refresh == mode.Refresh {
+			state.Modes[idx].Flags = mode.Flags
+			return
+		}
+	}
+	state.Modes = append(state.Modes, mode)
+}
+
+func (state WlOutputState) clone() WlOutputState {
+	state.Modes = append([]WlOutputMode(nil), state.Modes...)
+	return state
+}
+
+// WlOutput follows the state of an output as the client sees it. Events
+// change Pending, which wl_output.done applies to Current all at once.
 type WlOutput struct {
-	Object *WaylandObject
-	Name   string
-	Scale  int32
+	Object           *WaylandObject
+	Current, Pending WlOutputState
+	// Set when events arrived since the last done
+	Dirty bool
+	// Number of done events
+	Updates uint32
+	// Logical geometry from xdg-output, if the client asked for it
+	XdgOutput *ZxdgOutput
+}
+
+// apply makes the pending state current, along with that of the
+// xdg_output from its version 3.
+func (output *WlOutput) apply() {
+	output.Current = output.Pending.clone()
+	output.Dirty = false
+	output.Updates++
+	if z := output.XdgOutput; z != nil && z.Object.Version >= 3 {
+		z.apply()
+	}
+}
+
+// RefreshPeriod returns the duration of a refresh cycle of the current
+// mode, or 0 if unknown.
+func (output *WlOutput) RefreshPeriod() time.Duration {
+	mode := output.Current.CurrentMode()
+	if mode == nil || mode.Refresh <= 0 {
+		return 0
+	}
+	return time.Duration(int64(time.Second) * 1000 / int64(mode.Refresh))
+}
+
+// refreshPeriod returns the refresh period of the first output a surface is
+// on, or of any output of the client if the surface has not entered one.
+func (client *Client) refreshPeriod(surface *WlSurface) time.Duration {
+	outputs := surface.Outputs
+	if len(outputs) == 0 {
+		outputs = client.Objects
+	}
+	for _, obj := range outputs {
+		if output, ok := obj.Data.(*WlOutput); ok && !obj.Inert() && output.RefreshPeriod() > 0 {
+			return output.RefreshPeriod()
+		}
+	}
+	return 0
 }
 
 func (*WlOutput) DashboardShouldDisplay() bool {
@@ -19,14 +194,42 @@ func (*WlOutput) DashboardCategory() string {
 }
 
 func (output *WlOutput) DashboardPrint(printer func(string, ...interface{})) error {
-	s := output.Object.String()
-	if output.Name != "" {
-		s += fmt.Sprintf(" %q", output.Name)
+	state := &output.Current
+	s := fmt.Sprintf("%s v%d", output.Object, output.Object.Version)
+	if state.Name != "" {
+		s += fmt.Sprintf(" %q", state.Name)
 	}
-	if output.Scale != 0 {
-		s += fmt.Sprintf(", scale: %d", output.Scale)
+	if state.Description != "" {
+		s += ": " + state.Description
 	}
 	printer("%s - %s", Indent(0), s)
+	if output.Object.Inert() {
+		printer("%sunplugged at %s", Indent(3), output.Object.Global.Removed.Format("15:04:05.000"))
+	}
+	if output.XdgOutput != nil {
+		for _, d := range output.XdgOutput.Details() {
+			printer("%s%s", Indent(3), d)
+		}
+	}
+	if output.Updates == 0 && !output.Dirty {
+		return nil
+	}
+	if state.Make != "" || state.Model != "" {
+		printer("%s%s %s, %dx%d mm, subpixel: %s", Indent(3), state.Make, state.Model,
+			state.PhysicalWidth, state.PhysicalHeight, state.Subpixel)
+	}
+	printer("%sposition: %d,%d, transform: %s, scale: %d", Indent(3),
+		state.X, state.Y, state.Transform, state.Scale)
+	var modes []string
+	for _, mode := range state.Modes {
+		modes = append(modes, mode.String())
+	}
+	if len(modes) > 0 {
+		printer("%smodes: %s", Indent(3), strings.Join(modes, ", "))
+	}
+	if output.Dirty {
+		printer("%supdate pending, waiting for done", Indent(3))
+	}
 	return nil
 }
 
@@ -48,6 +251,8 @@ func RegisterWlOutput(client *Client) {
 func (r *WlOutputImpl) Create(obj *WaylandObject) Destroyable {
 	return &WlOutput{
 		Object: obj,
+		// Outputs without a scale event have a scale of 1
+		Pending: WlOutputState{Scale: 1},
 	}
 }
 
@@ -61,23 +266,87 @@ func (r *WlOutputImpl) Request(packet *WaylandPacket) error {
 func (r *WlOutputImpl) Event(packet *WaylandPacket) error {
 	object := r.client.ObjectMap[packet.ObjectId]
 	output := object.Data.(*WlOutput)
+	state := &output.Pending
 	switch packet.Opcode {
 	case 0: // geometry
+		var err error
+		if state.X, err = packet.ReadInt32(); err != nil {
+			return err
+		}
+		if state.Y, err = packet.ReadInt32(); err != nil {
+			return err
+		}
+		if state.PhysicalWidth, err = packet.ReadInt32(); err != nil {
+			return err
+		}
+		if state.PhysicalHeight, err = packet.ReadInt32(); err != nil {
+			return err
+		}
+		subpixel, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
+		state.Subpixel = EnumWlOutputSubpixel(subpixel)
+		if state.Make, err = packet.ReadString(); err != nil {
+			return err
+		}
+		if state.Model, err = packet.ReadString(); err != nil {
+			return err
+		}
+		transform, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
+		state.Transform = EnumWlOutputTransform(transform)
 	case 1: // mode
+		flags, err := packet.ReadUint32()
+		if err != nil {
+			return err
+		}
+		width, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
+		height, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
+		refresh, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
+		state.addMode(WlOutputMode{
+			Flags:   EnumWlOutputMode(flags),
+			Width:   width,
+			Height:  height,
+			Refresh: refresh,
+		})
 	case 2: // done
+		output.apply()
+		return nil
 	case 3: // scale
 		scale, err := packet.ReadInt32()
 		if err != nil {
 			return err
 		}
-		output.Scale = scale
+		state.Scale = scale
 	case 4: // name
 		name, err := packet.ReadString()
 		if err != nil {
 			return err
 		}
-		output.Name = name
+		state.Name = name
 	case 5: // description
+		description, err := packet.ReadString()
+		if err != nil {
+			return err
+		}
+		state.Description = description
+	}
+	output.Dirty = true
+	if object.Version < 2 {
+		// There is no done event before version 2
+		output.apply()
 	}
 	return nil
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Above this many operations, regions are not measured against their
+// surface
+const maxRegionOps = 64
+
+// RegionOp is a rectangle added to or subtracted from a region.
+type RegionOp struct {
+	Add bool
+	Rect
+}
+
+// Region is the sequence of operations that built a wl_region.
+type Region []RegionOp
+
+func (region Region) String() string {
+	if len(region) == 0 {
+		return "empty"
+	}
+	var ops []string
+	for _, op := range region {
+		sign := "-"
+		if op.Add {
+			sign = "+"
+		}
+		ops = append(ops, sign+op.Rect.String())
+	}
+	return strings.Join(ops, " ")
+}
+
+// contains reports whether the region covers the point.
+func (region Region) contains(x, y int64) bool {
+	inside := false
+	for _, op := range region {
+		if x >= int64(op.X) && x < int64(op.X)+int64(op.W) &&
+			y >= int64(op.Y) && y < int64(op.Y)+int64(op.H) {
+			inside = op.Add
+		}
+	}
+	return inside
+}
+
+// Area returns the area of the region within width x height, or -1 if the
+// region is too complex to measure.
+func (region Region) Area(width, height int32) int64 {
+	if len(region) > maxRegionOps {
+		return -1
+	}
+	xs := []int64{0, int64(width)}
+	ys := []int64{0, int64(height)}
+	for _, op := range region {
+		xs = append(xs, int64(op.X), int64(op.X)+int64(op.W))
+		ys = append(ys, int64(op.Y), int64(op.Y)+int64(op.H))
+	}
+	clip := func(v []int64, limit int64) []int64 {
+		sort.Slice(v, func(i, j int) bool { return v[i] < v[j] })
+		var out []int64
+		for _, c := range v {
+			if c >= 0 && c <= limit && (len(out) == 0 || out[len(out)-1] != c) {
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+	xs, ys = clip(xs, int64(width)), clip(ys, int64(height))
+
+	// Every cell of the grid made by the edges is either fully in or out
+	var area int64
+	for i := 0; i+1 < len(xs); i++ {
+		for j := 0; j+1 < len(ys); j++ {
+			if region.contains(xs[i], ys[j]) {
+				area += (xs[i+1] - xs[i]) * (ys[j+1] - ys[j])
+			}
+		}
+	}
+	return area
+}
+
+type WlRegion struct {
+	Object *WaylandObject
+	Region Region
+}
+
+func (*WlRegion) Destroy() error {
+	return nil
+}
+
+func (*WlRegion) DashboardShouldDisplay() bool {
+	return true
+}
+
+func (*WlRegion) DashboardCategory() string {
+	return "Regions"
+}
+
+func (r *WlRegion) DashboardPrint(printer func(string, ...interface{})) error {
+	printer("%s - %s: %s", Indent(0), r.Object, r.Region)
+	return nil
+}
+
+type WlRegionImpl struct {
+	client *Client
+}
+
+func RegisterWlRegion(client *Client) {
+	r := &WlRegionImpl{
+		client: client,
+	}
+	client.Impls["wl_region"] = r
+}
+
+func (r *WlRegionImpl) Request(packet *WaylandPacket) error {
+	region, ok := r.client.ObjectMap[packet.ObjectId].Data.(*WlRegion)
+	if !ok {
+		return errors.New("object is not wl_region")
+	}
+	switch packet.Opcode {
+	case 0: // destroy
+	case 1, 2: // add, subtract
+		x, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
+		y, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
+		w, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
+		h, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
+		if w > 0 && h > 0 {
+			region.Region = append(region.Region, RegionOp{packet.Opcode == 1, Rect{x, y, w, h}})
+		}
+	}
+	return nil
+}
+
+func (r *WlRegionImpl) Event(packet *WaylandPacket) error {
+	return errors.New("wl_region has no events")
+}
+
+// regionArgument returns a copy of the region passed to a request, or nil
+// for a null region.
+func (client *Client) regionArgument(packet *WaylandPacket) (Region, error) {
+	rid, err := packet.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	if rid == 0 {
+		return nil, nil
+	}
+	obj, ok := client.ObjectMap[rid]
+	if !ok {
+		return nil, fmt.Errorf("no such region %d", rid)
+	}
+	region, ok := obj.Data.(*WlRegion)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a region", obj)
+	}
+	// Later changes to the wl_region do not affect the surface
+	return append(Region{}, region.Region...), nil
+}
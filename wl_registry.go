@@ -24,11 +24,11 @@ func (r *WlRegistryImpl) Request(packet *WaylandPacket) error {
 		if !ok {
 			return errors.New("no such global")
 		}
-		_, err = packet.ReadString()
+		iface, err := packet.ReadString()
 		if err != nil {
 			return err
 		}
-		_, err = packet.ReadUint32()
+		version, err := packet.ReadUint32()
 		if err != nil {
 			return err
 		}
@@ -36,7 +36,17 @@ func (r *WlRegistryImpl) Request(packet *WaylandPacket) error {
 		if err != nil {
 			return err
 		}
+		if iface != global.Interface {
+			r.client.problem(false, nil, "global %d is %s, bound as %s",
+				gid, global.Interface, iface)
+		}
+		if version > global.Version || version == 0 {
+			r.client.problem(false, nil, "%s bound at version %d, advertised at version %d",
+				global.Interface, version, global.Version)
+		}
 		obj := r.client.NewObject(oid, global.Interface)
+		obj.Version = version
+		obj.Global = global
 		if impl, ok := r.client.Impls[global.Interface]; ok {
 			creatable, ok := impl.(interface {
 				Create(*WaylandObject) Destroyable
@@ -65,6 +75,14 @@ func (r *WlRegistryImpl) Event(packet *WaylandPacket) error {
 		if err != nil {
 			return errors.Wrap(err, "wl_registry decode version")
 		}
+		if old, ok := r.client.GlobalMap[gid]; ok && old.Removed.IsZero() {
+			if old.Interface == iface && old.Version == ver {
+				// Announced again to another wl_registry
+				return nil
+			}
+			r.client.problem(true, nil, "global %d announced as %s v%d while still %s v%d",
+				gid, iface, ver, old.Interface, old.Version)
+		}
 		global := &WaylandGlobal{
 			GlobalId:  gid,
 			Interface: iface,
@@ -73,6 +91,31 @@ func (r *WlRegistryImpl) Event(packet *WaylandPacket) error {
 		r.client.Globals = append(r.client.Globals, global)
 		r.client.GlobalMap[gid] = global
 	case 1: // global_remove
+		gid, err := packet.ReadUint32()
+		if err != nil {
+			return errors.Wrap(err, "wl_registry decode gid")
+		}
+		global, ok := r.client.GlobalMap[gid]
+		if !ok {
+			r.client.problem(true, nil, "global_remove for unknown global %d", gid)
+			return nil
+		}
+		// Kept in GlobalMap, as the client may bind it before it sees
+		// the removal
+		if global.Removed.IsZero() {
+			global.Removed = r.client.packetTime
+		}
 	}
 	return nil
 }
+
+// advertisedGlobals counts the globals that have not been removed.
+func (client *Client) advertisedGlobals() int {
+	n := 0
+	for _, global := range client.Globals {
+		if global.Removed.IsZero() {
+			n++
+		}
+	}
+	return n
+}
@@ -23,6 +23,9 @@ func (seat *WlSeat) DashboardPrint(printer func(string, ...interface{})) error {
 	if seat.Name != "" {
 		s += fmt.Sprintf(" %q", seat.Name)
 	}
+	if seat.Object.Inert() {
+		s += fmt.Sprintf(", removed at %s", seat.Object.Global.Removed.Format("15:04:05.000"))
+	}
 	printer("%s - %s", Indent(0), s)
 	for _, child := range seat.Children {
 		if i, ok := child.Data.(interface {
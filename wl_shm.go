@@ -7,20 +7,29 @@ import (
 
 type WlShmPool struct {
 	Object *WaylandObject
+	// Nil if the pool could not be mapped
+	mapping *ShmMapping
 }
 
-func (*WlShmPool) Destroy() error {
+func (pool *WlShmPool) Destroy() error {
+	pool.mapping.unref()
 	return nil
 }
 
 type WlShmBuffer struct {
 	Offset, Width, Height, Stride int32
 	Format                        uint32
+
+	mapping *ShmMapping
+}
+
+func (b *WlShmBuffer) Size() (int32, int32) {
+	return b.Width, b.Height
 }
 
 func (b *WlShmBuffer) String() string {
-	return fmt.Sprintf("shm, width: %d, height: %d, format: %d",
-		b.Width, b.Height, b.Format)
+	return fmt.Sprintf("shm, width: %d, height: %d, format: %s",
+		b.Width, b.Height, shmFormatName(b.Format))
 }
 
 type WlShmPoolImpl struct {
@@ -61,20 +70,30 @@ func (r *WlShmPoolImpl) Request(packet *WaylandPacket) error {
 		if err != nil {
 			return err
 		}
+		pool, ok := r.client.ObjectMap[packet.ObjectId].Data.(*WlShmPool)
+		if !ok {
+			return errors.New("object is not a wl_shm_pool")
+		}
 		obj := r.client.NewObject(oid, "wl_buffer")
 		b := &WlShmBuffer{
-			Offset: offset,
-			Width:  width,
-			Height: height,
-			Stride: stride,
-			Format: format,
-		}
-		obj.Data = &WlBuffer{
-			Object:     obj,
-			BufferType: b,
+			Offset:  offset,
+			Width:   width,
+			Height:  height,
+			Stride:  stride,
+			Format:  format,
+			mapping: pool.mapping.ref(),
 		}
+		r.client.NewBuffer(obj, b)
 	case 1: // destroy
 	case 2: // resize
+		size, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
+		pool, ok := r.client.ObjectMap[packet.ObjectId].Data.(*WlShmPool)
+		if ok && pool.mapping != nil {
+			pool.mapping.resize(size)
+		}
 	}
 	return nil
 }
@@ -110,9 +129,16 @@ func (r *WlShmImpl) Request(packet *WaylandPacket) error {
 		if err != nil {
 			return err
 		}
+		size, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
 		obj := r.client.NewObject(oid, "wl_shm_pool")
+		// Without a mapping, buffers of the pool have no preview
+		mapping, _ := r.client.mapShm(packet, size)
 		obj.Data = &WlShmPool{
-			Object: obj,
+			Object:  obj,
+			mapping: mapping,
 		}
 	}
 	return nil
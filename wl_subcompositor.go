@@ -51,12 +51,18 @@ func (r *WlSubCompositorImpl) Request(packet *WaylandPacket) error {
 		d := &WlSubSurface{
 			Object:  obj,
 			Surface: source_obj_surface,
+			Parent:  parent_obj_surface,
 		}
 		obj.Data = d
-		parent_obj_surface.Next.Children = append(parent_obj_surface.Next.Children, d)
+		// Added on top of the stack by the next commit of the parent
+		parent_obj_surface.Next.insertChild(d, len(parent_obj_surface.Next.Children), false)
+		source_obj_surface.SubSurface = d
+		// The role is not double-buffered
 		source_obj_surface.Next.Role = WlSubSurfaceState{
 			SubSurface: d,
 		}
+		source_obj_surface.Current.Role = source_obj_surface.Next.Role
+		source_obj_surface.Current.Parent = parent_obj_surface
 		source_obj_surface.Next.Parent = parent_obj_surface
 	}
 	return nil
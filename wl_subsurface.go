@@ -7,8 +7,6 @@ import (
 
 type WlSubSurfaceState struct {
 	SubSurface *WlSubSurface
-	X, Y       int32
-	Desync     bool
 }
 
 func (s WlSubSurfaceState) String() string {
@@ -16,21 +14,67 @@ func (s WlSubSurfaceState) String() string {
 }
 
 func (s WlSubSurfaceState) Details() []string {
-	return []string{
-		fmt.Sprintf("desync: %t, x: %d, y: %d", s.Desync, s.X, s.Y),
+	sub := s.SubSurface
+	mode := "sync"
+	if sub.Desync {
+		mode = "desync"
+		if sub.Surface.synchronized() {
+			mode += " (synchronized by an ancestor)"
+		}
+	}
+	details := []string{fmt.Sprintf("%s, x: %d, y: %d", mode, sub.X, sub.Y)}
+	if sub.NextX != sub.X || sub.NextY != sub.Y {
+		details[0] += fmt.Sprintf(", pending x: %d, y: %d", sub.NextX, sub.NextY)
+	}
+	if sub.Parent == nil {
+		details = append(details, "unmapped: its parent or subsurface is gone")
+	} else if idx := sub.Parent.Current.stack(sub); idx < 0 {
+		details = append(details, "not mapped until "+sub.Parent.Object.String()+" commits")
+	} else if idx < sub.Parent.Current.ChildrenBelow {
+		details[0] += ", below parent"
 	}
+	if cached := sub.Surface.Cached; cached != nil {
+		details = append(details, "commit cached until the parent commits")
+	}
+	return details
 }
 
 type WlSubSurface struct {
 	Object  *WaylandObject
 	Surface *WlSurface
+	// Nil once either surface or the subsurface is destroyed
+	Parent *WlSurface
+	// Position applied by parent commits, and pending position
+	X, Y         int32
+	NextX, NextY int32
+	Desync       bool
 }
 
 func (r *WlSubSurface) String() string {
 	return fmt.Sprintf("wl_subsurface@%d", r.Object.ObjectId)
 }
 
+// unlink takes the subsurface out of the stacks of its parent, leaving
+// its surface unmapped.
+func (r *WlSubSurface) unlink() {
+	if r.Parent != nil {
+		r.Parent.Current.removeChild(r)
+		r.Parent.Next.removeChild(r)
+		if r.Parent.Cached != nil {
+			r.Parent.Cached.removeChild(r)
+		}
+	}
+	r.Parent = nil
+	r.Surface.Current.Parent = nil
+	r.Surface.Next.Parent = nil
+	r.Surface.Cached = nil
+	r.Surface.SubSurface = nil
+}
+
 func (r *WlSubSurface) Destroy() error {
+	if r.Surface.SubSurface == r {
+		r.unlink()
+	}
 	return nil
 }
 
@@ -54,9 +98,11 @@ func (r *WlSubSurfaceImpl) Request(packet *WaylandPacket) error {
 	if !ok {
 		return errors.New("object is not wl_subsurface")
 	}
-	robj := obj.Surface.Next.Role.(WlSubSurfaceState)
 	switch packet.Opcode {
 	case 0: // destroy
+		if obj.Surface.SubSurface == obj {
+			obj.unlink()
+		}
 	case 1: // set_position
 		x, err := packet.ReadInt32()
 		if err != nil {
@@ -66,17 +112,57 @@ func (r *WlSubSurfaceImpl) Request(packet *WaylandPacket) error {
 		if err != nil {
 			return err
 		}
-		robj.X, robj.Y = x, y
-	case 2: // place_above
-
-	case 3: // place_below
+		// Applied on the next commit of the parent
+		obj.NextX, obj.NextY = x, y
+	case 2, 3: // place_above, place_below
+		sid, err := packet.ReadUint32()
+		if err != nil {
+			return err
+		}
+		sibling, ok := r.client.ObjectMap[sid]
+		if !ok {
+			return fmt.Errorf("no such surface %d", sid)
+		}
+		return obj.place(sibling, packet.Opcode == 2)
 	case 4: // set_sync
-		robj.Desync = false
+		obj.Desync = false
 	case 5: // set_desync
-		robj.Desync = true
+		obj.Desync = true
+		// Whatever was cached is applied at once if the surface is no
+		// longer synchronized
+		if cached := obj.Surface.Cached; cached != nil && !obj.Surface.synchronized() {
+			if err := r.client.applyState(obj.Surface, *cached); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	obj.Surface.Next.Role = robj
+// place restacks the subsurface right above or below a sibling or its
+// parent, in the pending state of the parent.
+func (r *WlSubSurface) place(sibling *WaylandObject, above bool) error {
+	if r.Parent == nil {
+		return nil
+	}
+	state := &r.Parent.Next
+	if sibling == r.Parent.Object {
+		state.removeChild(r)
+		state.insertChild(r, state.ChildrenBelow, !above)
+		return nil
+	}
+	surface, ok := sibling.Data.(*WlSurface)
+	if !ok || surface.SubSurface == nil || surface.SubSurface == r ||
+		state.stack(surface.SubSurface) < 0 {
+		return fmt.Errorf("%s is not a sibling of %s", sibling, r)
+	}
+	state.removeChild(r)
+	idx := state.stack(surface.SubSurface)
+	below := idx < state.ChildrenBelow
+	if above {
+		idx++
+	}
+	state.insertChild(r, idx, below)
 	return nil
 }
 
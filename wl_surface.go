@@ -13,15 +13,64 @@ type WlSurfaceRole interface {
 }
 
 type WlSurfaceState struct {
-	Buffer                             *WaylandObject
-	BufferNum                          int
-	BufferX, BufferY                   int32
-	DamageX, DamageY, DamageW, DamageH int32
-	Scale                              int32
-	Transform                          int32
-	Parent                             *WlSurface
-	Children                           []*WlSubSurface
-	Role                               WlSurfaceRole
+	Buffer           *WaylandObject
+	BufferNum        int
+	BufferX, BufferY int32
+	// Damage since the last commit, in surface and buffer coordinates
+	Damage, BufferDamage []Rect
+	// Nil when unset: nothing is opaque and all of the surface takes
+	// input
+	Opaque, Input Region
+	Scale         int32
+	Transform     int32
+	Parent        *WlSurface
+	// Subsurfaces in stacking order, bottom first. The first
+	// ChildrenBelow of them are stacked below the surface itself.
+	Children      []*WlSubSurface
+	ChildrenBelow int
+	Role          WlSurfaceRole
+}
+
+// stack returns the position of a subsurface in Children, or -1.
+func (state *WlSurfaceState) stack(sub *WlSubSurface) int {
+	for idx, child := range state.Children {
+		if child == sub {
+			return idx
+		}
+	}
+	return -1
+}
+
+// removeChild takes a subsurface out of the stack.
+func (state *WlSurfaceState) removeChild(sub *WlSubSurface) {
+	idx := state.stack(sub)
+	if idx < 0 {
+		return
+	}
+	state.Children = append(state.Children[:idx:idx], state.Children[idx+1:]...)
+	if idx < state.ChildrenBelow {
+		state.ChildrenBelow--
+	}
+}
+
+// insertChild puts a subsurface at a position in the stack, below the
+// surface itself if below is set.
+func (state *WlSurfaceState) insertChild(sub *WlSubSurface, idx int, below bool) {
+	children := make([]*WlSubSurface, 0, len(state.Children)+1)
+	children = append(children, state.Children[:idx]...)
+	children = append(children, sub)
+	state.Children = append(children, state.Children[idx:]...)
+	if below {
+		state.ChildrenBelow++
+	}
+}
+
+// clone returns a copy of the state that does not share its slices.
+func (state WlSurfaceState) clone() WlSurfaceState {
+	state.Children = append([]*WlSubSurface(nil), state.Children...)
+	state.Damage = append([]Rect(nil), state.Damage...)
+	state.BufferDamage = append([]Rect(nil), state.BufferDamage...)
+	return state
 }
 
 type WlSurface struct {
@@ -31,8 +80,21 @@ type WlSurface struct {
 	PreferredBufferScale     int32
 	PreferredBufferTransform int32
 	Current, Next            WlSurfaceState
-	Outputs                  []*WaylandObject
-	Buffers                  []*WaylandObject
+	// State committed by a synchronized subsurface, waiting for a
+	// commit of its parent
+	Cached *WlSurfaceState
+	// Set if the surface has the subsurface role
+	SubSurface *WlSubSurface
+	Outputs    []*WaylandObject
+	Buffers    []*WaylandObject
+	Timing     FrameTiming
+	Damage     DamageStats
+	// Set by wp_viewporter.get_viewport
+	Viewport *WpViewport
+	// Contents of the last shm buffer committed, nil if none
+	Snapshot *Snapshot
+
+	flaggedRoleless bool
 }
 
 func (surface *WlSurface) dashboardOutput(printer func(string, ...interface{}), indent int) error {
@@ -45,7 +107,7 @@ func (surface *WlSurface) dashboardOutput(printer func(string, ...interface{}),
 		details = surface.Current.Role.Details()
 	}
 
-	printer("%s - %s, role: %s", Indent(indent), surface.Object, rolestr)
+	printer("%s - %s v%d, role: %s", Indent(indent), surface.Object, surface.Object.Version, rolestr)
 	if len(surface.Buffers) > 0 {
 		var x []string
 		for _, obj := range surface.Buffers {
@@ -64,6 +126,9 @@ func (surface *WlSurface) dashboardOutput(printer func(string, ...interface{}),
 	if surface.RequestedFrames > 0 {
 		bufferStr = append(bufferStr, fmt.Sprintf("frames: %d/%d", surface.Frames, surface.RequestedFrames))
 	}
+	if surface.Snapshot != nil {
+		bufferStr = append(bufferStr, fmt.Sprintf("snapshot: commit %d", surface.Snapshot.Commit))
+	}
 	if len(bufferStr) > 0 {
 		printer("%s%s", Indent(indent+3), strings.Join(bufferStr, ", "))
 	}
@@ -71,10 +136,23 @@ func (surface *WlSurface) dashboardOutput(printer func(string, ...interface{}),
 	if len(surface.Outputs) > 0 {
 		var x []string
 		for _, obj := range surface.Outputs {
-			x = append(x, obj.String())
+			if obj.Inert() {
+				x = append(x, obj.String()+" (unplugged)")
+			} else {
+				x = append(x, obj.String())
+			}
 		}
 		printer("%soutputs: %s", Indent(indent+3), strings.Join(x, ", "))
 	}
+	for _, d := range surface.Timing.Details() {
+		printer("%s%s", Indent(indent+3), d)
+	}
+	for _, d := range surface.regionDetails() {
+		printer("%s%s", Indent(indent+3), d)
+	}
+	for _, d := range surface.Damage.Details() {
+		printer("%s%s", Indent(indent+3), d)
+	}
 	if surface.PreferredBufferScale != 0 || surface.PreferredBufferTransform != 0 {
 		printer("%spreferred scale: %d, preferred transform: %d", Indent(indent+3), surface.PreferredBufferScale, surface.PreferredBufferTransform)
 	}
@@ -94,26 +172,185 @@ func (*WlSurface) DashboardCategory() string {
 	return "Surfaces"
 }
 
+// DashboardShouldDisplay shows a surface on its own unless it is drawn as
+// part of the tree of its parent, which it is only once the parent has
+// committed.
 func (surface *WlSurface) DashboardShouldDisplay() bool {
-	return surface.Current.Parent == nil
+	sub := surface.SubSurface
+	return sub == nil || sub.Parent == nil || sub.Parent.Current.stack(sub) < 0
 }
 
 func (surface *WlSurface) DashboardPrint(printer func(string, ...interface{})) error {
 	return surface.dashboardOutput(printer, 0)
 }
 
-func (r *WlSurface) Done() error {
+// regionDetails describes the opaque and input regions set on the surface,
+// measured against its size as of its last frame.
+func (surface *WlSurface) regionDetails() []string {
+	var details []string
+	describe := func(name string, region Region) {
+		if region == nil {
+			return
+		}
+		s := fmt.Sprintf("%s region: %s", name, region)
+		width, height := surface.Damage.Width, surface.Damage.Height
+		if width > 0 && height > 0 {
+			if area := region.Area(width, height); area >= 0 {
+				s += fmt.Sprintf(", %.1f%% of the surface",
+					float64(area)*100/(float64(width)*float64(height)))
+			}
+		}
+		details = append(details, s)
+	}
+	describe("opaque", surface.Current.Opaque)
+	describe("input", surface.Current.Input)
+	return details
+}
+
+// synchronized reports whether commits of the surface are cached until its
+// parent commits: it is a subsurface in synchronized mode, or has such an
+// ancestor.
+func (surface *WlSurface) synchronized() bool {
+	for sub := surface.SubSurface; sub != nil && sub.Parent != nil; sub = sub.Parent.SubSurface {
+		if !sub.Desync {
+			return true
+		}
+	}
+	return false
+}
+
+// cache merges the pending state into the cached state of a synchronized
+// subsurface.
+func (surface *WlSurface) cache() {
+	state := surface.Next.clone()
+	if cached := surface.Cached; cached != nil {
+		damage := cached.Damage
+		for _, r := range state.Damage {
+			damage = addDamage(damage, r)
+		}
+		bufferDamage := cached.BufferDamage
+		for _, r := range state.BufferDamage {
+			bufferDamage = addDamage(bufferDamage, r)
+		}
+		state.Damage, state.BufferDamage = damage, bufferDamage
+	}
+	surface.Cached = &state
+}
+
+// applyState makes state the current state of the surface, as the
+// compositor does on commit, and records the frame. It then applies the
+// pending position and cached state of its synchronized subsurfaces.
+func (client *Client) applyState(surface *WlSurface, state WlSurfaceState) error {
+	// The buffer only goes to the compositor if attached since the
+	// last commit
+	attached := state.BufferNum != surface.Current.BufferNum
+	if previous := surface.Current.Buffer; attached && previous != nil && previous != state.Buffer {
+		if buffer, ok := previous.Data.(*WlBuffer); ok {
+			buffer.replaced(client.packetTime)
+		}
+	}
+	surface.Current = state.clone()
+	surface.Cached = nil
+
+	damage := -1.0
+	if surface.Current.Buffer != nil {
+		buffer, ok := surface.Current.Buffer.Data.(*WlBuffer)
+		if !ok {
+			return errors.New("attached buffer is not a buffer")
+		}
+		buffer.Committed = true
+		if attached {
+			buffer.commit(client.packetTime)
+			surface.takeSnapshot(buffer, client.packetTime)
+			damage = surface.Damage.frame(surface.Current.Damage, surface.Current.BufferDamage,
+				surface.geometry(buffer))
+		}
+	}
+	sample := surface.Timing.commit(surface.Object.ObjectId, client.packetTime,
+		client.refreshPeriod(surface))
+	sample.Damage = damage
+	client.proxy.notifyFrame(client, sample)
+
+	for _, child := range surface.Current.Children {
+		child.X, child.Y = child.NextX, child.NextY
+		if cached := child.Surface.Cached; cached != nil && child.Surface.synchronized() {
+			if err := client.applyState(child.Surface, *cached); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// geometry gathers the state needed to map the damage of a buffer
+// committed to the surface.
+func (surface *WlSurface) geometry(buffer *WlBuffer) *surfaceGeometry {
+	g := &surfaceGeometry{
+		Scale:     max(surface.Current.Scale, 1),
+		Transform: surface.Current.Transform,
+		Viewport:  surface.Viewport,
+	}
+	g.BufferWidth, g.BufferHeight = buffer.BufferType.Size()
+	return g
+}
+
+// takeSnapshot copies the contents of a newly committed shm buffer. The
+// snapshot of the previous one is kept if the copy fails.
+func (surface *WlSurface) takeSnapshot(buffer *WlBuffer, t time.Time) {
+	shm, ok := buffer.BufferType.(*WlShmBuffer)
+	if !ok {
+		return
+	}
+	snap := surface.Snapshot
+	if snap == nil {
+		snap = &Snapshot{}
+	}
+	if err := shm.snapshot(snap); err != nil {
+		return
+	}
+	snap.Time = t
+	snap.Commit = surface.Timing.Commits + 1
+	surface.Snapshot = snap
+}
+
+// captureBuffer attaches the contents of a shm buffer attached since the
+// last commit to the commit packet, so that a replay can draw the same
+// frame. Buffers larger than captureMaxFdContent are left out.
+func (surface *WlSurface) captureBuffer(packet *WaylandPacket) {
+	state := surface.Next
+	if state.Buffer == nil || state.BufferNum == surface.Current.BufferNum {
+		return
+	}
+	buffer, ok := state.Buffer.Data.(*WlBuffer)
+	if !ok {
+		return
+	}
+	shm, ok := buffer.BufferType.(*WlShmBuffer)
+	if !ok || int64(shm.Stride)*int64(shm.Height) > captureMaxFdContent {
+		return
+	}
+	content, err := shm.contents(nil)
+	if err != nil {
+		return
+	}
+	packet.Content = &CaptureBuffer{Buffer: state.Buffer.ObjectId, Content: content}
+}
+
+func (r *WlSurface) Done(callback *WaylandObject, t time.Time) error {
 	r.Frames += 1
+	r.Timing.done(callback.ObjectId, t)
 	return nil
 }
 
 func (r *WlSurface) Destroy() error {
-	if r.Next.Parent != nil {
-		for idx := range r.Next.Parent.Next.Children {
-			if r.Next.Parent.Next.Children[idx].Surface == r {
-				r.Next.Parent.Next.Children = append(r.Next.Parent.Next.Children[:idx], r.Next.Parent.Next.Children[idx+1:]...)
-				break
-			}
+	if r.SubSurface != nil {
+		r.SubSurface.unlink()
+	}
+	// Subsurfaces of a destroyed surface are unmapped
+	children := append(append([]*WlSubSurface(nil), r.Current.Children...), r.Next.Children...)
+	for _, child := range children {
+		if child.Parent == r {
+			child.unlink()
 		}
 	}
 	return nil
@@ -179,8 +416,16 @@ func (r *WlSurfaceImpl) Request(packet *WaylandPacket) error {
 			return err
 		}
 		obj.Next.BufferNum = obj.Current.BufferNum + 1
-		obj.Next.BufferX = x
-		obj.Next.BufferY = y
+		if object.Version >= 5 {
+			// The offset has its own request from version 5
+			if x != 0 || y != 0 {
+				r.client.problem(false, object, "%s.attach with offset %d,%d, use wl_surface.offset since version 5",
+					object, x, y)
+			}
+		} else {
+			obj.Next.BufferX = x
+			obj.Next.BufferY = y
+		}
 
 		if bid == 0 {
 			obj.Next.Buffer = nil
@@ -201,6 +446,7 @@ func (r *WlSurfaceImpl) Request(packet *WaylandPacket) error {
 			buf:     buffer_obj,
 		}
 		buffer.Attached = true
+		buffer.attach(object, r.client.packetTime)
 		for idx := range obj.Buffers {
 			if obj.Buffers[idx] == buffer_obj {
 				obj.Buffers = append(obj.Buffers[:idx], obj.Buffers[idx+1:]...)
@@ -225,10 +471,7 @@ func (r *WlSurfaceImpl) Request(packet *WaylandPacket) error {
 		if err != nil {
 			return err
 		}
-		obj.Next.DamageX = x
-		obj.Next.DamageY = y
-		obj.Next.DamageW = w
-		obj.Next.DamageH = h
+		obj.Next.Damage = addDamage(obj.Next.Damage, Rect{x, y, w, h})
 	case 3: // frame
 		oid, err := packet.ReadUint32()
 		if err != nil {
@@ -241,22 +484,32 @@ func (r *WlSurfaceImpl) Request(packet *WaylandPacket) error {
 			Subscriber:  obj,
 		}
 		obj.RequestedFrames += 1
+		obj.Timing.frame(oid, r.client.packetTime)
 
 	case 4: // set_opaque_region
+		region, err := r.client.regionArgument(packet)
+		if err != nil {
+			return err
+		}
+		obj.Next.Opaque = region
 	case 5: // set_input_region
-	case 6: // commit
-		// TODO: maybe we're messing up the children slice when we do things like this
-		obj.Current = obj.Next
-		if obj.Current.Buffer != nil {
-			buffer, ok := obj.Current.Buffer.Data.(*WlBuffer)
-			if !ok {
-				return errors.New("attached buffer is not a buffer")
-			}
-			buffer.Committed = true
+		region, err := r.client.regionArgument(packet)
+		if err != nil {
+			return err
 		}
-		if r.client.proxy.SlowMode {
-			time.Sleep(250 * time.Millisecond)
+		obj.Next.Input = region
+	case 6: // commit
+		r.client.checkCommit(obj)
+		if r.client.proxy.Capture != nil {
+			obj.captureBuffer(packet)
+		}
+		if obj.synchronized() {
+			// Applied, and timed, along with the parent
+			obj.cache()
+		} else if err := r.client.applyState(obj, obj.Next); err != nil {
+			return err
 		}
+		obj.Next.Damage, obj.Next.BufferDamage = nil, nil
 	case 7: // set_buffer_transform
 		transform, err := packet.ReadInt32()
 		if err != nil {
@@ -270,10 +523,6 @@ func (r *WlSurfaceImpl) Request(packet *WaylandPacket) error {
 		}
 		obj.Next.Scale = scale
 	case 9: // damage_buffer
-		scale := obj.Current.Scale
-		if scale == 0 {
-			scale = 1
-		}
 		x, err := packet.ReadInt32()
 		if err != nil {
 			return err
@@ -290,10 +539,9 @@ func (r *WlSurfaceImpl) Request(packet *WaylandPacket) error {
 		if err != nil {
 			return err
 		}
-		obj.Next.DamageX = x * scale
-		obj.Next.DamageY = y * scale
-		obj.Next.DamageW = w * scale
-		obj.Next.DamageH = h * scale
+		// Mapped to the surface at commit, with the scale and
+		// transform of that commit
+		obj.Next.BufferDamage = addDamage(obj.Next.BufferDamage, Rect{x, y, w, h})
 	case 10: // offset
 		x, err := packet.ReadInt32()
 		if err != nil {
@@ -325,6 +573,10 @@ func (r *WlSurfaceImpl) Event(packet *WaylandPacket) error {
 		if output_obj == nil {
 			return errors.New("no such output object")
 		}
+		if output_obj.Inert() {
+			r.client.problem(true, object, "%s.enter for %s, which was unplugged",
+				object, output_obj)
+		}
 		obj.Outputs = append(obj.Outputs, output_obj)
 	case 1: // leave
 		sid, err := packet.ReadUint32()
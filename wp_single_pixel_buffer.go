@@ -9,6 +9,10 @@ type WpSinglePixelBuffer struct {
 	Red, Green, Blue, Alpha uint32
 }
 
+func (*WpSinglePixelBuffer) Size() (int32, int32) {
+	return 1, 1
+}
+
 func (b *WpSinglePixelBuffer) String() string {
 	return fmt.Sprintf("single-pixel-buffer, r: %d, g: %d, b: %d, a: %d",
 		b.Red, b.Green, b.Blue, b.Alpha)
@@ -64,10 +68,7 @@ func (r *WpSinglePixelBufferManagerImpl) Request(packet *WaylandPacket) error {
 			Blue:  blue,
 			Alpha: alpha,
 		}
-		obj.Data = &WlBuffer{
-			Object:     obj,
-			BufferType: b,
-		}
+		r.client.NewBuffer(obj, b)
 	}
 	return nil
 }
@@ -15,6 +15,9 @@ type WpViewport struct {
 }
 
 func (w *WpViewport) Destroy() error {
+	if surface, ok := w.Surface.Data.(*WlSurface); ok && surface.Viewport == w {
+		surface.Viewport = nil
+	}
 	return nil
 }
 
@@ -140,10 +143,14 @@ func (w *WpViewporterImpl) Request(packet *WaylandPacket) error {
 			return fmt.Errorf("no such surface object: %d", sid)
 		}
 		obj := w.client.NewObject(oid, "wp_viewport")
-		obj.Data = &WpViewport{
+		viewport := &WpViewport{
 			Object:  obj,
 			Surface: sobj,
 		}
+		obj.Data = viewport
+		if surface, ok := sobj.Data.(*WlSurface); ok {
+			surface.Viewport = viewport
+		}
 	}
 	return nil
 }
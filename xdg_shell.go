@@ -79,9 +79,31 @@ func (s XdgSurfaceState) Details() []string {
 	return nil
 }
 
+// Most configures remembered per xdg_surface until the client acks one
+const maxPendingConfigures = 64
+
 type XdgSurface struct {
 	Object  *WaylandObject
 	Surface *WlSurface
+	// Serials of the configures sent and not acked yet
+	Configures []int32
+	// Set once a configure has been acked
+	Configured bool
+
+	flaggedUnconfigured bool
+}
+
+// ack takes the serial of an acked configure off the list, along with
+// those sent before it, and reports whether it was sent at all.
+func (s *XdgSurface) ack(serial int32) bool {
+	for idx, sent := range s.Configures {
+		if sent == serial {
+			s.Configures = s.Configures[idx+1:]
+			s.Configured = true
+			return true
+		}
+	}
+	return false
 }
 
 func (s *XdgSurface) Destroy() error {
@@ -244,6 +266,10 @@ func (r *XdgSurfaceImpl) Request(packet *WaylandPacket) error {
 		if err != nil {
 			return err
 		}
+		if !xdg_surface.ack(conf) {
+			r.client.problem(false, object, "%s.ack_configure with unknown serial %d",
+				object, uint32(conf))
+		}
 		if robj.PendingConfigure.Serial == conf {
 			robj.CurrentConfigure = robj.PendingConfigure
 		}
@@ -262,6 +288,11 @@ func (r *XdgSurfaceImpl) Event(packet *WaylandPacket) error {
 			return err
 		}
 		robj.PendingConfigure.Serial = conf
+		xdg_surface := object.Data.(*XdgSurface)
+		xdg_surface.Configures = append(xdg_surface.Configures, conf)
+		if len(xdg_surface.Configures) > maxPendingConfigures {
+			xdg_surface.Configures = xdg_surface.Configures[1:]
+		}
 	}
 	object.Data.(*XdgSurface).Surface.Next.Role = robj
 	return nil
@@ -531,6 +562,8 @@ func (r *XdgToplevelImpl) Event(packet *WaylandPacket) error {
 				}
 			}
 			states = append(states, EnumXdgState(state))
+			// Tiled and suspended states depend on the version
+			r.client.checkEnum(object, true, messageName(object, packet), "state", uint32(state))
 		}
 
 		xdgstate.PendingConfigure.Width = width
@@ -10,6 +10,10 @@ type ZwpLinuxDmabufBuffer struct {
 	Format, Flags uint32
 }
 
+func (b *ZwpLinuxDmabufBuffer) Size() (int32, int32) {
+	return b.Width, b.Height
+}
+
 func (b *ZwpLinuxDmabufBuffer) String() string {
 	return fmt.Sprintf("linux-dmabuf, width: %d, height: %d, format: %d",
 		b.Width, b.Height, b.Format)
@@ -97,11 +101,7 @@ func (r *ZwpLinuxBufferParamsImpl) Request(packet *WaylandPacket) error {
 			Flags:  flags,
 		}
 		obj := r.client.NewObject(oid, "wl_buffer")
-
-		obj.Data = &WlBuffer{
-			Object:     obj,
-			BufferType: data.Creating,
-		}
+		r.client.NewBuffer(obj, data.Creating)
 	}
 	return nil
 }
@@ -120,10 +120,7 @@ func (r *ZwpLinuxBufferParamsImpl) Event(packet *WaylandPacket) error {
 			return err
 		}
 		obj := r.client.NewObject(oid, "wl_buffer")
-		obj.Data = &WlBuffer{
-			Object:     obj,
-			BufferType: data.Creating,
-		}
+		r.client.NewBuffer(obj, data.Creating)
 	case 1: // failed
 	}
 	return nil
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ---------------------------------------------------------------------------
+// zxdg_output_v1
+// ---------------------------------------------------------------------------
+
+// ZxdgOutputState is the logical geometry of an output, in the global
+// compositor space.
+type ZxdgOutputState struct {
+	X, Y              int32
+	Width, Height     int32
+	Name, Description string
+}
+
+// ZxdgOutput follows an xdg_output of a wl_output. Events change Pending,
+// which is applied by zxdg_output_v1.done before version 3 and by
+// wl_output.done from version 3.
+type ZxdgOutput struct {
+	Object           *WaylandObject
+	Output           *WlOutput
+	Current, Pending ZxdgOutputState
+	// Set when events arrived since the last done
+	Dirty bool
+}
+
+func (z *ZxdgOutput) apply() {
+	z.Current = z.Pending
+	z.Dirty = false
+}
+
+func (z *ZxdgOutput) Destroy() error {
+	if z.Output != nil && z.Output.XdgOutput == z {
+		z.Output.XdgOutput = nil
+	}
+	return nil
+}
+
+// Details describes the logical geometry for the output it belongs to.
+func (z *ZxdgOutput) Details() []string {
+	state := &z.Current
+	s := fmt.Sprintf("logical: %dx%d at %d,%d (%s)", state.Width, state.Height,
+		state.X, state.Y, z.Object)
+	if state.Name != "" {
+		s += fmt.Sprintf(", name: %q", state.Name)
+	}
+	if state.Description != "" {
+		s += fmt.Sprintf(", description: %q", state.Description)
+	}
+	details := []string{s}
+	if z.Dirty {
+		details = append(details, "logical update pending, waiting for done")
+	}
+	return details
+}
+
+type ZxdgOutputImpl struct {
+	client *Client
+}
+
+func RegisterZxdgOutput(client *Client) {
+	r := &ZxdgOutputImpl{
+		client: client,
+	}
+	client.Impls["zxdg_output_v1"] = r
+}
+
+func (r *ZxdgOutputImpl) Request(packet *WaylandPacket) error {
+	switch packet.Opcode {
+	case 0: // destroy
+	}
+	return nil
+}
+
+func (r *ZxdgOutputImpl) Event(packet *WaylandPacket) error {
+	object := r.client.ObjectMap[packet.ObjectId]
+	z, ok := object.Data.(*ZxdgOutput)
+	if !ok {
+		return errors.New("object is not zxdg_output_v1")
+	}
+	state := &z.Pending
+	switch packet.Opcode {
+	case 0: // logical_position
+		x, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
+		y, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
+		state.X, state.Y = x, y
+	case 1: // logical_size
+		width, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
+		height, err := packet.ReadInt32()
+		if err != nil {
+			return err
+		}
+		state.Width, state.Height = width, height
+	case 2: // done
+		z.apply()
+		return nil
+	case 3: // name
+		name, err := packet.ReadString()
+		if err != nil {
+			return err
+		}
+		state.Name = name
+	case 4: // description
+		description, err := packet.ReadString()
+		if err != nil {
+			return err
+		}
+		state.Description = description
+	}
+	z.Dirty = true
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// zxdg_output_manager_v1
+// ---------------------------------------------------------------------------
+
+type ZxdgOutputManager struct {
+	Object *WaylandObject
+}
+
+func (z *ZxdgOutputManager) Destroy() error {
+	return nil
+}
+
+type ZxdgOutputManagerImpl struct {
+	client *Client
+}
+
+func RegisterZxdgOutputManager(client *Client) {
+	r := &ZxdgOutputManagerImpl{
+		client: client,
+	}
+	client.Impls["zxdg_output_manager_v1"] = r
+}
+
+func (r *ZxdgOutputManagerImpl) Create(obj *WaylandObject) Destroyable {
+	return &ZxdgOutputManager{Object: obj}
+}
+
+func (r *ZxdgOutputManagerImpl) Request(packet *WaylandPacket) error {
+	switch packet.Opcode {
+	case 0: // destroy
+	case 1: // get_xdg_output
+		oid, err := packet.ReadUint32()
+		if err != nil {
+			return err
+		}
+		outputId, err := packet.ReadUint32()
+		if err != nil {
+			return err
+		}
+		outputObj, ok := r.client.ObjectMap[outputId]
+		if !ok {
+			return fmt.Errorf("zxdg_output_manager_v1: no such output object: %d", outputId)
+		}
+		output, ok := outputObj.Data.(*WlOutput)
+		if !ok {
+			return fmt.Errorf("zxdg_output_manager_v1: %s is not an output", outputObj)
+		}
+		obj := r.client.NewObject(oid, "zxdg_output_v1")
+		z := &ZxdgOutput{
+			Object: obj,
+			Output: output,
+		}
+		obj.Data = z
+		output.XdgOutput = z
+	}
+	return nil
+}
+
+func (r *ZxdgOutputManagerImpl) Event(packet *WaylandPacket) error {
+	return errors.New("zxdg_output_manager_v1 has no events")
+}